@@ -0,0 +1,132 @@
+package virtualbox
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type BandwidthGroupType string
+
+const (
+	BandwidthGroup_network = BandwidthGroupType("Network")
+	BandwidthGroup_disk    = BandwidthGroupType("Disk")
+)
+
+// bandwidth limits are in bytes per second, these help spelling them
+const (
+	KBps int64 = 1024
+	MBps       = 1024 * KBps
+	GBps       = 1024 * MBps
+)
+
+// BandwidthGroup caps the throughput of the nics or disks assigned to it
+type BandwidthGroup struct {
+	Name string
+	Type BandwidthGroupType
+	// Limit in bytes per second, 0 means unlimited. bandwidthctl is kilobyte granular, so limits are
+	// rounded down to a multiple of KBps
+	Limit int64
+}
+
+// AddBandwidthGroup adds a bandwidth group to vm
+func (vb *VBox) AddBandwidthGroup(vm *VirtualMachine, group BandwidthGroup) error {
+	_, err := vb.manage("bandwidthctl", vm.UUIDOrName(), "add", group.Name,
+		"--type", strings.ToLower(string(group.Type)), "--limit", formatBandwidthLimit(group.Limit))
+	if err != nil && isAlreadyExistErrorMessage(err.Error()) {
+		return AlreadyExistsErrorr.New(group.Name, "use SetBandwidthLimit")
+	}
+	return err
+}
+
+// SetBandwidthLimit changes the limit of a bandwidth group, this takes effect immediately on running vms
+func (vb *VBox) SetBandwidthLimit(vm *VirtualMachine, name string, limit int64) error {
+	_, err := vb.manage("bandwidthctl", vm.UUIDOrName(), "set", name, "--limit", formatBandwidthLimit(limit))
+	return err
+}
+
+// RemoveBandwidthGroup removes a bandwidth group, it must not be in use by any nic or disk
+func (vb *VBox) RemoveBandwidthGroup(vm *VirtualMachine, name string) error {
+	_, err := vb.manage("bandwidthctl", vm.UUIDOrName(), "remove", name)
+	return err
+}
+
+func (vb *VBox) ListBandwidthGroups(vm *VirtualMachine) ([]BandwidthGroup, error) {
+	out, err := vb.manage("bandwidthctl", vm.UUIDOrName(), "list", "--machinereadable")
+	if err != nil {
+		return nil, err
+	}
+
+	var groups []BandwidthGroup
+	err = parseKeyValues(out, reKeyEqVal, func(key, val string) error {
+		if !strings.HasPrefix(key, "BandwidthGroup") {
+			return nil
+		}
+		group, err := parseBandwidthGroup(val)
+		if err != nil {
+			return err
+		}
+		groups = append(groups, group)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return groups, nil
+}
+
+// parseBandwidthGroup parses the machine readable form of a group, e.g Limit,Network,20M
+func parseBandwidthGroup(val string) (BandwidthGroup, error) {
+	parts := strings.Split(strings.Trim(val, "\""), ",")
+	n := len(parts)
+	if n < 3 {
+		return BandwidthGroup{}, fmt.Errorf("cannot parse bandwidth group %s", val)
+	}
+
+	limit, err := parseBandwidthLimit(parts[n-1])
+	if err != nil {
+		return BandwidthGroup{}, err
+	}
+
+	// names may contain commas, type and limit never do
+	return BandwidthGroup{Name: strings.Join(parts[:n-2], ","), Type: BandwidthGroupType(parts[n-2]), Limit: limit}, nil
+}
+
+// formatBandwidthLimit renders limit with the largest unit that represents it exactly. bandwidthctl reads upper
+// case units as bytes and lower case ones as bits, a bare number would be taken as megabytes
+func formatBandwidthLimit(limit int64) string {
+	switch {
+	case limit == 0:
+		return "0"
+	case limit%GBps == 0:
+		return fmt.Sprintf("%dG", limit/GBps)
+	case limit%MBps == 0:
+		return fmt.Sprintf("%dM", limit/MBps)
+	}
+	return fmt.Sprintf("%dK", limit/KBps)
+}
+
+// parseBandwidthLimit parses limits in bytes per second. Upper case units are binary bytes and lower case units
+// decimal bits, a bare number is in bytes per second
+func parseBandwidthLimit(limit string) (int64, error) {
+	type unit struct{ multiplier, divisor int64 }
+	units := map[byte]unit{
+		'K': {KBps, 1}, 'M': {MBps, 1}, 'G': {GBps, 1},
+		'k': {1000, 8}, 'm': {1000 * 1000, 8}, 'g': {1000 * 1000 * 1000, 8},
+	}
+
+	limit = strings.TrimSpace(limit)
+	u := unit{1, 1}
+	if n := len(limit); n > 0 {
+		if v, ok := units[limit[n-1]]; ok {
+			u, limit = v, limit[:n-1]
+		}
+	}
+
+	v, err := strconv.ParseInt(limit, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("cannot parse bandwidth limit %s", limit)
+	}
+	return v * u.multiplier / u.divisor, nil
+}
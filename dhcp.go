@@ -2,9 +2,23 @@ package virtualbox
 
 import (
 	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 )
 
+const (
+	dhcpOptRouter = 3
+	dhcpOptDNS    = 6
+	dhcpOptDomain = 15
+)
+
+// parses option lines of list dhcpservers like the following
+//          6/legacy: 8.8.8.8
+var reDHCPOptionLine = regexp.MustCompile(`^\s*(\d+)/[^:]*:\s*(.*)`)
+
 func (vb *VBox) DisableDHCPServer(netName string) (string, error) {
 	_, err := vb.manage("dhcpserver", "remove", "--netname", netName)
 	if err != nil && !strings.Contains(err.Error(), "does not exist") {
@@ -14,5 +28,266 @@ func (vb *VBox) DisableDHCPServer(netName string) (string, error) {
 }
 
 func (vb *VBox) EnableDHCPServer(netName string, ip string, netmask string, lowerIP string, upperIP string) (string, error) {
-	return vb.manage("dhcpserver", "add", "--netname", netName, fmt.Sprintf("--ip=%s", ip), fmt.Sprintf("--netmask=%s", netmask), fmt.Sprintf("--lowerip=%s", lowerIP), fmt.Sprintf("--upperip=%s", upperIP), "--enable")
+	return vb.manage(append([]string{"dhcpserver", "add"}, (&DHCPServerConfig{
+		NetworkName:    netName,
+		IPAddress:      ip,
+		NetworkMask:    netmask,
+		LowerIPAddress: lowerIP,
+		UpperIPAddress: upperIP,
+		Enabled:        BoolPtr(true),
+	}).args()...)...)
+}
+
+// AddDHCPServer adds a dhcp server as described by config
+func (vb *VBox) AddDHCPServer(config *DHCPServerConfig) error {
+	_, err := vb.manage(append([]string{"dhcpserver", "add"}, config.args()...)...)
+	if err != nil && isAlreadyExistErrorMessage(err.Error()) {
+		return AlreadyExistsErrorr.New(config.target(), "use ModifyDHCPServer")
+	}
+	return err
+}
+
+// ModifyDHCPServer updates an existing dhcp server. Options are set on top of the existing ones, options
+// not mentioned in config are left as is
+func (vb *VBox) ModifyDHCPServer(config *DHCPServerConfig) error {
+	_, err := vb.manage(append([]string{"dhcpserver", "modify"}, config.args()...)...)
+	return err
+}
+
+// EnsureDHCPServer adds the dhcp server or modifies it if one already exists for the same target
+func (vb *VBox) EnsureDHCPServer(config *DHCPServerConfig) error {
+	err := vb.AddDHCPServer(config)
+	if IsAlreadyExistsError(err) {
+		return vb.ModifyDHCPServer(config)
+	}
+	return err
+}
+
+// RestartDHCPServer restarts a running dhcp server so it picks up modified configuration
+func (vb *VBox) RestartDHCPServer(config *DHCPServerConfig) error {
+	_, err := vb.manage(append([]string{"dhcpserver", "restart"}, config.targetArgs()...)...)
+	return err
+}
+
+func (c *DHCPServerConfig) target() string {
+	if c.Interface != "" {
+		return c.Interface
+	}
+	return c.NetworkName
+}
+
+func (c *DHCPServerConfig) targetArgs() []string {
+	if c.Interface != "" {
+		return []string{"--interface", c.Interface}
+	}
+	return []string{"--netname", c.NetworkName}
+}
+
+func (c *DHCPServerConfig) args() []string {
+	args := c.targetArgs()
+
+	if c.IPAddress != "" {
+		args = append(args, fmt.Sprintf("--ip=%s", c.IPAddress))
+	}
+	if c.NetworkMask != "" {
+		args = append(args, fmt.Sprintf("--netmask=%s", c.NetworkMask))
+	}
+	if c.LowerIPAddress != "" {
+		args = append(args, fmt.Sprintf("--lowerip=%s", c.LowerIPAddress))
+	}
+	if c.UpperIPAddress != "" {
+		args = append(args, fmt.Sprintf("--upperip=%s", c.UpperIPAddress))
+	}
+	if c.Enabled != nil {
+		if *c.Enabled {
+			args = append(args, "--enable")
+		} else {
+			args = append(args, "--disable")
+		}
+	}
+
+	// scoped options apply to the last --global, --group, --vm or --mac-address preceding them
+	if opts := c.Global.args(); len(opts) > 0 {
+		args = append(append(args, "--global"), opts...)
+	}
+
+	for _, g := range c.Groups {
+		args = append(args, fmt.Sprintf("--group=%s", g.Name))
+		for _, mac := range g.MACs {
+			args = append(args, fmt.Sprintf("--incl-mac=%s", mac))
+		}
+		args = append(args, g.Options.args()...)
+	}
+
+	for _, v := range c.VMs {
+		args = append(args, fmt.Sprintf("--vm=%s", v.VM), fmt.Sprintf("--nic=%d", v.NIC))
+		if v.Remove {
+			args = append(args, "--remove-config")
+			continue
+		}
+		if v.FixedAddress != "" {
+			args = append(args, fmt.Sprintf("--fixed-address=%s", v.FixedAddress))
+		}
+		args = append(args, v.Options.args()...)
+	}
+
+	for _, m := range c.MACs {
+		args = append(args, fmt.Sprintf("--mac-address=%s", m.MAC))
+		if m.FixedAddress != "" {
+			args = append(args, fmt.Sprintf("--fixed-address=%s", m.FixedAddress))
+		}
+		args = append(args, m.Options.args()...)
+	}
+
+	return args
+}
+
+func (o *DHCPOptions) args() []string {
+	var args []string
+
+	setOpt := func(opt int, val string) {
+		args = append(args, fmt.Sprintf("--set-opt=%d", opt), val)
+	}
+
+	if len(o.DNS) > 0 {
+		setOpt(dhcpOptDNS, strings.Join(o.DNS, ","))
+	}
+	if o.Router != "" {
+		setOpt(dhcpOptRouter, o.Router)
+	}
+	if o.Domain != "" {
+		setOpt(dhcpOptDomain, o.Domain)
+	}
+
+	// sorted for a stable command line
+	var others []int
+	for opt := range o.Other {
+		others = append(others, opt)
+	}
+	sort.Ints(others)
+	for _, opt := range others {
+		setOpt(opt, o.Other[opt])
+	}
+
+	if o.LeaseTime > 0 {
+		args = append(args, fmt.Sprintf("--default-lease-time=%d", int(o.LeaseTime.Seconds())))
+	}
+
+	return args
+}
+
+func (o *DHCPOptions) set(opt int, val string) {
+	switch opt {
+	case dhcpOptDNS:
+		o.DNS = strings.FieldsFunc(val, func(r rune) bool {
+			return r == ',' || r == ' ' || r == ';'
+		})
+	case dhcpOptRouter:
+		o.Router = val
+	case dhcpOptDomain:
+		o.Domain = val
+	default:
+		if o.Other == nil {
+			o.Other = make(map[int]string)
+		}
+		o.Other[opt] = val
+	}
+}
+
+// parseDHCPServers parses the output of list dhcpservers. Both the flat listing of older versions and the
+// scoped listing (global, groups and individual configs) of VirtualBox 6.1 and later are understood
+func parseDHCPServers(out string) (map[string]*DHCPServer, error) {
+	m := make(map[string]*DHCPServer)
+
+	var dhcpServer *DHCPServer
+	var opts *DHCPOptions
+	var fixedAddress *string
+
+	err := parseKeyValues(out, reColonLine, func(key, val string) error {
+		key = strings.TrimSpace(key)
+
+		if key != "NetworkName" && dhcpServer == nil {
+			return nil
+		}
+
+		if res := reDHCPOptionLine.FindStringSubmatch(key + ": " + val); res != nil {
+			if opt, err := strconv.Atoi(res[1]); err == nil && opts != nil {
+				opts.set(opt, strings.TrimSpace(res[2]))
+			}
+			return nil
+		}
+
+		switch key {
+		case "NetworkName":
+			dhcpServer = &DHCPServer{}
+			m[val] = dhcpServer
+			dhcpServer.NetworkName = val
+			if strings.HasPrefix(val, "HostInterfaceNetworking-") {
+				dhcpServer.Interface = val[len("HostInterfaceNetworking-"):]
+			}
+			opts, fixedAddress = &dhcpServer.Global, nil
+		case "IP", "Dhcpd IP":
+			dhcpServer.IPAddress = val
+		case "upperIPAddress", "UpperIPAddress":
+			dhcpServer.UpperIPAddress = val
+		case "lowerIPAddress", "LowerIPAddress":
+			dhcpServer.LowerIPAddress = val
+		case "NetworkMask":
+			dhcpServer.NetworkMask = val
+		case "Enabled":
+			dhcpServer.Enabled = BoolPtr(val == "Yes")
+		case "Global Configuration":
+			opts, fixedAddress = &dhcpServer.Global, nil
+		case "Group":
+			dhcpServer.Groups = append(dhcpServer.Groups, DHCPGroupConfig{Name: val})
+			g := &dhcpServer.Groups[len(dhcpServer.Groups)-1]
+			opts, fixedAddress = &g.Options, nil
+		case "Incl. MAC":
+			if n := len(dhcpServer.Groups); n > 0 {
+				dhcpServer.Groups[n-1].MACs = append(dhcpServer.Groups[n-1].MACs, val)
+			}
+		case "Individual Config":
+			opts, fixedAddress = dhcpServer.addIndividualConfig(val)
+		case "Fixed Address":
+			if fixedAddress != nil {
+				*fixedAddress = val
+			}
+		case "defaultLeaseTime", "Default Lease Time":
+			if fields := strings.Fields(val); opts != nil && len(fields) > 0 {
+				if secs, err := strconv.Atoi(fields[0]); err == nil {
+					opts.LeaseTime = time.Duration(secs) * time.Second
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// addIndividualConfig adds a vm or mac config from a header value like "VM NIC: <uuid>/1" or
+// "MAC Address: 08:00:27:00:00:01" and returns its options and fixed address for the lines that follow
+func (s *DHCPServer) addIndividualConfig(header string) (*DHCPOptions, *string) {
+	kind, val := header, ""
+	if i := strings.Index(header, ":"); i >= 0 {
+		kind, val = strings.TrimSpace(header[:i]), strings.TrimSpace(header[i+1:])
+	}
+
+	if strings.EqualFold(kind, "MAC Address") {
+		s.MACs = append(s.MACs, DHCPMACConfig{MAC: val})
+		c := &s.MACs[len(s.MACs)-1]
+		return &c.Options, &c.FixedAddress
+	}
+
+	c := DHCPVMConfig{VM: val}
+	if i := strings.LastIndex(val, "/"); i >= 0 {
+		c.VM = val[:i]
+		c.NIC, _ = strconv.Atoi(val[i+1:])
+	}
+	s.VMs = append(s.VMs, c)
+	v := &s.VMs[len(s.VMs)-1]
+	return &v.Options, &v.FixedAddress
 }
@@ -0,0 +1,108 @@
+package virtualbox
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDHCPServerConfigArgs(t *testing.T) {
+	config := DHCPServerConfig{
+		NetworkName: "labnet",
+		IPAddress:   "10.0.0.2",
+		NetworkMask: "255.255.255.0",
+		Enabled:     BoolPtr(true),
+		Global: DHCPOptions{
+			DNS:       []string{"10.0.0.1", "8.8.8.8"},
+			LeaseTime: time.Hour,
+		},
+		MACs: []DHCPMACConfig{
+			{MAC: "08:00:27:00:00:01", FixedAddress: "10.0.0.10"},
+		},
+	}
+
+	expected := "--netname labnet --ip=10.0.0.2 --netmask=255.255.255.0 --enable " +
+		"--global --set-opt=6 10.0.0.1,8.8.8.8 --default-lease-time=3600 " +
+		"--mac-address=08:00:27:00:00:01 --fixed-address=10.0.0.10"
+	if args := strings.Join(config.args(), " "); args != expected {
+		t.Errorf("expected %s, got %s", expected, args)
+	}
+
+	// servers are left enabled or disabled unless asked otherwise
+	config = DHCPServerConfig{Interface: "vboxnet0", LowerIPAddress: "192.168.56.50"}
+	if args := strings.Join(config.args(), " "); args != "--interface vboxnet0 --lowerip=192.168.56.50" {
+		t.Errorf("expected no enable flag, got %s", args)
+	}
+
+	config.VMs = []DHCPVMConfig{{VM: "vm01", NIC: 1, FixedAddress: "192.168.56.10", Remove: true}}
+	if args := strings.Join(config.args(), " "); !strings.HasSuffix(args, "--vm=vm01 --nic=1 --remove-config") {
+		t.Errorf("expected the vm config removed, got %s", args)
+	}
+}
+
+func TestParseDHCPServers(t *testing.T) {
+	var sampleOut = `NetworkName:    HostInterfaceNetworking-vboxnet0
+Dhcpd IP:       192.168.56.100
+LowerIPAddress: 192.168.56.101
+UpperIPAddress: 192.168.56.254
+NetworkMask:    255.255.255.0
+Enabled:        Yes
+Global Configuration:
+    minLeaseTime:     default
+    defaultLeaseTime: 600 sec
+    maxLeaseTime:     default
+    Forced options:   None
+    Suppressed opts.: None
+        1/legacy: 255.255.255.0
+        6/legacy: 192.168.56.1
+Groups:               None
+Individual Configs:
+Individual Config:    MAC Address: 08:00:27:00:00:01
+    minLeaseTime:     default
+    Fixed Address:    192.168.56.10
+        3/legacy: 192.168.56.1
+
+NetworkName:    NatNetwork
+IP:             10.0.2.3
+NetworkMask:    255.255.255.0
+lowerIPAddress: 10.0.2.4
+upperIPAddress: 10.0.2.254
+Enabled:        No
+`
+
+	servers, err := parseDHCPServers(sampleOut)
+	if err != nil {
+		t.Fatalf("error parsing %v", err)
+	}
+
+	hostOnly, ok := servers["HostInterfaceNetworking-vboxnet0"]
+	if !ok {
+		t.Fatalf("expected hostonly dhcp server, got %#v", servers)
+	}
+
+	expected := DHCPServerConfig{
+		NetworkName:    "HostInterfaceNetworking-vboxnet0",
+		Interface:      "vboxnet0",
+		IPAddress:      "192.168.56.100",
+		NetworkMask:    "255.255.255.0",
+		LowerIPAddress: "192.168.56.101",
+		UpperIPAddress: "192.168.56.254",
+		Enabled:        BoolPtr(true),
+		Global: DHCPOptions{
+			DNS:       []string{"192.168.56.1"},
+			LeaseTime: 600 * time.Second,
+			Other:     map[int]string{1: "255.255.255.0"},
+		},
+		MACs: []DHCPMACConfig{
+			{MAC: "08:00:27:00:00:01", FixedAddress: "192.168.56.10", Options: DHCPOptions{Router: "192.168.56.1"}},
+		},
+	}
+	if !reflect.DeepEqual(expected, hostOnly.DHCPServerConfig) {
+		t.Errorf("expected %#v, got %#v", expected, hostOnly.DHCPServerConfig)
+	}
+
+	if nat, ok := servers["NatNetwork"]; !ok || nat.LowerIPAddress != "10.0.2.4" || nat.Enabled == nil || *nat.Enabled {
+		t.Errorf("nat network dhcp server not parsed as expected, got %#v", nat)
+	}
+}
@@ -3,6 +3,10 @@ package virtualbox
 import (
 	"context"
 	"fmt"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 )
 
@@ -14,6 +18,39 @@ const (
 	VHD  = DiskFormat("VHD")
 )
 
+// DiskVariant is the allocation layout of a disk image, variants can be combined where the format allows it
+type DiskVariant string
+
+const (
+	DiskVariant_standard = DiskVariant("Standard")
+	DiskVariant_fixed    = DiskVariant("Fixed")
+	// Split2G and Stream are only supported by VMDK
+	DiskVariant_split2g = DiskVariant("Split2G")
+	DiskVariant_stream  = DiskVariant("Stream")
+	// Diff disks are differencing children of a parent disk
+	DiskVariant_diff = DiskVariant("Diff")
+)
+
+// CloneOptions tune CloneDisk
+type CloneOptions struct {
+	// Variants of the clone, defaults to Standard
+	Variants []DiskVariant
+	// Existing copies into the existing image at dst.Path instead of creating one, the image is grown to fit
+	Existing bool
+}
+
+// MediumType controls how writes to a disk behave, e.g immutable disks discard writes on vm power off
+type MediumType string
+
+const (
+	MediumType_normal       = MediumType("normal")
+	MediumType_immutable    = MediumType("immutable")
+	MediumType_writethrough = MediumType("writethrough")
+	MediumType_shareable    = MediumType("shareable")
+	MediumType_readonly     = MediumType("readonly")
+	MediumType_multiattach  = MediumType("multiattach")
+)
+
 type DiskNotFoundError string
 
 func (d DiskNotFoundError) Error() string {
@@ -25,20 +62,93 @@ func IsDiskNotFound(err error) bool {
 	return ok
 }
 
+// EnsureDisk creates disk when it does not exist and grows it when disk.SizeMB is larger than its capacity.
+// Disks with a Parent are created as differencing children of the parent, which has to exist or be creatable
+// from its own spec. Encryption and a MediumType set on the spec are applied to the existing disk
 func (vb *VBox) EnsureDisk(context context.Context, disk *Disk) (*Disk, error) {
+	if disk.Type == DVDDrive {
+		return vb.ensureDVD(disk)
+	}
+
+	if disk.Encryption != nil {
+		var verr ValidationErrors
+		validateEncryption([]Disk{*disk}, &verr)
+		if len(verr.errors) > 0 {
+			return nil, verr
+		}
+	}
+
+	var parent *Disk
+	if disk.Parent != nil {
+		var err error
+		if parent, err = vb.EnsureDisk(context, disk.Parent); err != nil {
+			return nil, err
+		}
+		disk.Parent.UUID = parent.UUID
+	}
+
 	d, err := vb.DiskInfo(disk)
 	if IsDiskNotFound(err) {
-		err = vb.CreateDisk(disk)
+		if parent != nil {
+			_, err = vb.CreateDiffDisk(parent, disk.Path)
+		} else if disk.RawDevice != "" {
+			err = vb.CreateRawDiskVMDK(disk.Path, disk.RawDevice, disk.RawPartitions)
+		} else {
+			err = vb.CreateDisk(disk)
+		}
 		if err != nil {
 			return nil, err
 		} else {
 			d, err = vb.DiskInfo(disk)
 		}
+	} else if err == nil && parent != nil && d.ParentUUID != parent.UUID {
+		return nil, fmt.Errorf("disk %s exists but is not a child of %s", disk.UUIDorPath(), parent.UUIDorPath())
+	} else if err == nil && disk.SizeMB > d.SizeMB {
+		if err = vb.ResizeDisk(d, disk.SizeMB); err != nil {
+			return nil, err
+		}
+		d, err = vb.DiskInfo(disk)
+	}
+
+	if err == nil && disk.Encryption != nil && !d.Encrypted {
+		enc := disk.Encryption
+		if err = vb.EncryptDisk(d, enc.Cipher, enc.PasswordID, enc.PasswordFile); err != nil {
+			return nil, err
+		}
+		d.Encrypted = true
+	}
+
+	if err == nil && disk.MediumType != "" && d.MediumType != disk.MediumType {
+		if err = vb.SetMediumType(d, disk.MediumType); err != nil {
+			return nil, err
+		}
+		d.MediumType = disk.MediumType
 	}
 
 	return d, err
 }
 
+// ensureDVD checks that the image of a dvd drive exists, images are never created. Empty and host drives are
+// returned as is
+func (vb *VBox) ensureDVD(disk *Disk) (*Disk, error) {
+	if disk.Path == "" || disk.HostDrive != "" {
+		d := *disk
+		return &d, nil
+	}
+	return vb.DiskInfo(disk)
+}
+
+// medium is the value of storageattach --medium for disk
+func (disk *Disk) medium() string {
+	switch {
+	case disk.HostDrive != "":
+		return "host:" + disk.HostDrive
+	case disk.Type == DVDDrive && disk.Path == "":
+		return "emptydrive"
+	}
+	return disk.Path
+}
+
 func (disk *Disk) UUIDorPath() string {
 	var uuidOrPath string
 	if disk.UUID != "" {
@@ -64,37 +174,414 @@ func (vb *VBox) DiskInfo(disk *Disk) (*Disk, error) {
 	}
 
 	var ndisk Disk
-	_ = parseKeyValues(out, reColonLine, func(key, val string) error {
+	if disks := parseMediumInfo(out); len(disks) > 0 {
+		ndisk = disks[0]
+	}
+
+	if ndisk.UUID == "" {
+		return &ndisk, DiskNotFoundError(disk.UUIDorPath())
+	}
+
+	return &ndisk, nil
+}
+
+// CreateDisk creates the disk image at disk.Path. Diff disks are created on top of disk.Parent
+func (vb *VBox) CreateDisk(disk *Disk) error {
+	if disk.hasVariant(DiskVariant_diff) {
+		if disk.Parent == nil {
+			return ValidationError{Path: "variant", Err: fmt.Errorf("variant %s needs a parent disk", DiskVariant_diff)}
+		}
+		_, err := vb.CreateDiffDisk(disk.Parent, disk.Path)
+		return err
+	}
+
+	args, err := createDiskArgs(disk)
+	if err != nil {
+		return err
+	}
+	_, err = vb.manage(args...)
+	return err
+}
+
+func createDiskArgs(disk *Disk) ([]string, error) {
+	if disk.Format == "" {
+		disk.Format = VDI
+	}
+
+	args := []string{"createmedium", "disk", "--filename", disk.Path, "--size", fmt.Sprintf("%d", disk.SizeMB),
+		"--format", string(disk.Format)}
+
+	var variants []string
+	for _, v := range disk.Variants {
+		if err := checkDiskVariant(v, disk.Format); err != nil {
+			return nil, err
+		}
+		variants = append(variants, string(v))
+	}
+	if len(variants) > 0 {
+		args = append(args, "--variant", strings.Join(variants, ","))
+	}
+
+	names := make([]string, 0, len(disk.Properties))
+	for name := range disk.Properties {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		args = append(args, "--property", name+"="+disk.Properties[name])
+	}
+	return args, nil
+}
+
+func checkDiskVariant(v DiskVariant, format DiskFormat) error {
+	if (v == DiskVariant_split2g || v == DiskVariant_stream) && format != VMDK {
+		return ValidationError{Path: "variant", Err: fmt.Errorf("variant %s needs format VMDK, got %s", v, format)}
+	}
+	return nil
+}
+
+// parseDiskVariants maps the format variant printed by showmediuminfo, e.g "fixed default" or
+// "fixed vmdk split2G", to every variant it names. Dynamic disks without other flags are Standard
+func parseDiskVariants(val string) []DiskVariant {
+	var variants []DiskVariant
+	for _, flag := range strings.Fields(strings.ToLower(val)) {
+		switch {
+		case flag == "differencing":
+			variants = append(variants, DiskVariant_diff)
+		case flag == "fixed":
+			variants = append(variants, DiskVariant_fixed)
+		case flag == "split2g":
+			variants = append(variants, DiskVariant_split2g)
+		case strings.HasPrefix(flag, "stream"):
+			variants = append(variants, DiskVariant_stream)
+		}
+	}
+	if len(variants) == 0 {
+		variants = append(variants, DiskVariant_standard)
+	}
+	return variants
+}
+
+func (disk *Disk) hasVariant(v DiskVariant) bool {
+	for _, dv := range disk.Variants {
+		if dv == v {
+			return true
+		}
+	}
+	return false
+}
+
+// ListMedia lists the registered media of kind, which is one of HDDrive, DVDDrive or FDDrive. Differencing
+// disks are linked to their parents through Parent and Children
+func (vb *VBox) ListMedia(kind DiskType) ([]Disk, error) {
+	lists := map[DiskType]string{HDDrive: "hdds", DVDDrive: "dvds", FDDrive: "floppies"}
+	list, ok := lists[kind]
+	if !ok {
+		return nil, fmt.Errorf("unknown medium kind %s", kind)
+	}
+
+	out, err := vb.manage("list", list, "--long")
+	if err != nil {
+		return nil, err
+	}
+
+	disks := parseMediumInfo(out)
+	byUUID := make(map[string]*Disk, len(disks))
+	for i := range disks {
+		disks[i].Type = kind
+		byUUID[disks[i].UUID] = &disks[i]
+	}
+	for i := range disks {
+		if parent, ok := byUUID[disks[i].ParentUUID]; ok {
+			disks[i].Parent = parent
+			parent.Children = append(parent.Children, &disks[i])
+		}
+	}
+	return disks, nil
+}
+
+// matches the first line of a medium attribute, values spanning several lines continue on indented lines
+var reMediumInfoLine = regexp.MustCompile(`^(\S[^:]*):\s*(.*)$`)
+
+var reMediumInUseBy = regexp.MustCompile(`\(UUID: ([0-9a-fA-F-]+)\)`)
+
+// parseMediumInfo parses the output of showmediuminfo and list --long of media, where disks are separated by
+// blank lines. Multi line values look like the following
+//  In use by VMs:  vm1 (UUID: 3c1c5d2e-...)
+//                  vm2 (UUID: 8d0e4f1a-...)
+func parseMediumInfo(out string) []Disk {
+	var disks []Disk
+	var disk *Disk
+	var key string
+
+	setValue := func(key, val string) {
 		switch key {
 		case "UUID":
-			ndisk.UUID = val
+			disk.UUID = val
+		case "Parent UUID":
+			if val != "base" {
+				disk.ParentUUID = val
+			}
+		case "Child UUIDs":
+			disk.ChildUUIDs = append(disk.ChildUUIDs, val)
+		case "State":
+			disk.State = val
+		case "Type":
+			// e.g normal (base), immutable (differencing)
+			if fields := strings.Fields(val); len(fields) > 0 {
+				disk.MediumType = MediumType(fields[0])
+			}
 		case "Location":
-			ndisk.Path = val
+			disk.Path = val
 		case "Storage format":
-			ndisk.Format = DiskFormat(val)
+			disk.Format = DiskFormat(val)
+		case "Format variant":
+			disk.Variants = parseDiskVariants(val)
+		case "Capacity":
+			disk.SizeMB = parseMBytes(val)
+		case "Size on disk":
+			disk.SizeOnDiskMB = parseMBytes(val)
+		case "Encryption":
+			disk.Encrypted = val == "enabled"
+		case "Property":
+			if kv := strings.SplitN(val, "=", 2); len(kv) == 2 {
+				if disk.Properties == nil {
+					disk.Properties = map[string]string{}
+				}
+				disk.Properties[kv[0]] = kv[1]
+			}
+		case "In use by VMs":
+			if m := reMediumInUseBy.FindStringSubmatch(val); m != nil {
+				disk.InUseByVMs = append(disk.InUseByVMs, m[1])
+			}
 		}
+	}
 
+	_ = tryParseKeyValues(out, reMediumInfoLine, func(k, val string, ok bool) error {
+		val = strings.TrimSpace(val)
+		switch {
+		case ok:
+			if disk == nil {
+				disks = append(disks, Disk{})
+				disk = &disks[len(disks)-1]
+			}
+			key = k
+			setValue(key, val)
+		case val == "":
+			disk, key = nil, ""
+		case disk != nil && key != "":
+			setValue(key, val)
+		}
 		return nil
 	})
 
-	if ndisk.UUID == "" {
-		return &ndisk, DiskNotFoundError(disk.UUIDorPath())
+	return disks
+}
+
+// CloneDisk copies src into a new image at dst.Path, converting it to dst.Format. The format defaults to the one
+// matching the file extension of dst.Path. dst.UUID is set to the uuid of the clone, which is returned as
+// reported by DiskInfo
+func (vb *VBox) CloneDisk(src, dst *Disk, opts CloneOptions) (*Disk, error) {
+	args, err := cloneDiskArgs(src, dst, opts)
+	if err != nil {
+		return nil, err
 	}
 
-	return &ndisk, nil
+	out, err := vb.manage(args...)
+	if err != nil {
+		if isFileNotFoundMessage(out) || isFileNotFoundMessage(err.Error()) {
+			return nil, DiskNotFoundError(src.UUIDorPath())
+		}
+		return nil, err
+	}
+
+	d, err := vb.DiskInfo(&Disk{Path: dst.Path, Type: dst.Type})
+	if err != nil {
+		return nil, err
+	}
+	dst.UUID = d.UUID
+	return d, nil
 }
 
-func (vb *VBox) CreateDisk(disk *Disk) error {
-	if disk.Format == "" {
-		disk.Format = VDI
+func cloneDiskArgs(src, dst *Disk, opts CloneOptions) ([]string, error) {
+	if dst.Path == "" {
+		return nil, ValidationError{Path: "dst/path", Err: fmt.Errorf("clone target path is empty")}
+	}
+	if dst.Format == "" {
+		dst.Format = diskFormatFromPath(dst.Path)
+	}
+
+	var variants []string
+	for _, v := range opts.Variants {
+		if err := checkDiskVariant(v, dst.Format); err != nil {
+			return nil, err
+		}
+		variants = append(variants, string(v))
+	}
+
+	args := []string{"clonemedium"}
+	if kind := src.Type.ForShowMedium(); kind != "" {
+		args = append(args, kind)
+	}
+	args = append(args, src.UUIDorPath(), dst.Path, "--format", string(dst.Format))
+	if len(variants) > 0 {
+		args = append(args, "--variant", strings.Join(variants, ","))
+	}
+	if opts.Existing {
+		args = append(args, "--existing")
+	}
+	return args, nil
+}
+
+func diskFormatFromPath(path string) DiskFormat {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".vmdk":
+		return VMDK
+	case ".vhd":
+		return VHD
+	}
+	return VDI
+}
+
+// CreateDiffDisk creates a differencing image at path on top of base, writes to the new disk leave base
+// untouched. Bases shared by many vms are best marked MediumType_multiattach or MediumType_immutable
+func (vb *VBox) CreateDiffDisk(base *Disk, path string) (*Disk, error) {
+	_, err := vb.manage("createmedium", "disk", "--filename", path, "--diffparent", base.UUIDorPath(),
+		"--format", string(diskFormatFromPath(path)))
+	if err != nil {
+		if isFileNotFoundMessage(err.Error()) {
+			return nil, DiskNotFoundError(base.UUIDorPath())
+		}
+		return nil, err
+	}
+	return vb.DiskInfo(&Disk{Path: path, Type: HDDrive})
+}
+
+// CreateRawDiskVMDK creates a VMDK at path that maps the host block device, e.g /dev/sdb or a loop device. Only
+// the listed partitions are accessible to the vm when partitions is not empty. Raw access needs read and write
+// permission on the device
+func (vb *VBox) CreateRawDiskVMDK(path, device string, partitions []int) error {
+	major, err := vb.MajorVersion()
+	if err != nil {
+		return err
+	}
+	_, err = vb.manage(rawDiskVMDKArgs(major, path, device, partitions)...)
+	return err
+}
+
+// rawDiskVMDKArgs uses createmedium on VirtualBox 7, which replaced the internal createrawvmdk command
+func rawDiskVMDKArgs(major int, path, device string, partitions []int) []string {
+	parts := make([]string, 0, len(partitions))
+	for _, p := range partitions {
+		parts = append(parts, strconv.Itoa(p))
 	}
 
-	_, err := vb.manage("createmedium", "disk", "--filename", disk.Path, "--size", fmt.Sprintf("%d", disk.SizeMB),
-		"--format", string(disk.Format))
+	if major < 7 {
+		args := []string{"internalcommands", "createrawvmdk", "-filename", path, "-rawdisk", device}
+		if len(parts) > 0 {
+			args = append(args, "-partitions", strings.Join(parts, ","))
+		}
+		return args
+	}
+
+	args := []string{"createmedium", "disk", "--filename", path, "--format", string(VMDK), "--variant", "RawDisk",
+		"--property", "RawDrive=" + device}
+	if len(parts) > 0 {
+		args = append(args, "--property", "Partitions="+strings.Join(parts, ","))
+	}
+	return args
+}
 
+// ResizeDisk grows disk to newSizeMB, shrinking is refused since virtualbox cannot shrink images
+func (vb *VBox) ResizeDisk(disk *Disk, newSizeMB int64) error {
+	d, err := vb.DiskInfo(disk)
+	if err != nil {
+		return err
+	}
+
+	if newSizeMB < d.SizeMB {
+		return ValidationError{Path: "size", Err: fmt.Errorf("cannot shrink %s from %dMB to %dMB", disk.UUIDorPath(), d.SizeMB, newSizeMB)}
+	}
+	if newSizeMB == d.SizeMB {
+		return nil
+	}
+
+	if _, err := vb.modifyMedium(disk, "--resize", strconv.FormatInt(newSizeMB, 10)); err != nil {
+		return err
+	}
+	disk.SizeMB = newSizeMB
+	return nil
+}
+
+// CompactDisk reclaims the zeroed blocks of a dynamically allocated disk
+func (vb *VBox) CompactDisk(disk *Disk) error {
+	_, err := vb.modifyMedium(disk, "--compact")
 	return err
 }
 
+// SetMediumType changes the type of disk, it must not be attached to any vm
+func (vb *VBox) SetMediumType(disk *Disk, mediumType MediumType) error {
+	_, err := vb.modifyMedium(disk, "--type", string(mediumType))
+	return err
+}
+
+// SetAutoReset sets whether the differencing image of an immutable disk is reset on every vm start
+func (vb *VBox) SetAutoReset(disk *Disk, on bool) error {
+	state := "off"
+	if on {
+		state = "on"
+	}
+	_, err := vb.modifyMedium(disk, "--autoreset", state)
+	return err
+}
+
+// SetMediumProperty sets a format specific property of disk, e.g the iscsi target of an iscsi disk
+func (vb *VBox) SetMediumProperty(disk *Disk, name, value string) error {
+	_, err := vb.modifyMedium(disk, "--property", name+"="+value)
+	return err
+}
+
+func (vb *VBox) modifyMedium(disk *Disk, args ...string) (string, error) {
+	margs := []string{"modifymedium"}
+	if kind := disk.Type.ForShowMedium(); kind != "" {
+		margs = append(margs, kind)
+	}
+	margs = append(margs, disk.UUIDorPath())
+
+	out, err := vb.manage(append(margs, args...)...)
+	if err != nil && isFileNotFoundMessage(err.Error()) {
+		return out, DiskNotFoundError(disk.UUIDorPath())
+	}
+	return out, err
+}
+
+// parseMBytes parses sizes as printed by showmediuminfo, e.g 1000 MBytes or 512 KBytes, in MB. Partial MBs
+// are rounded up to a whole MB
+func parseMBytes(val string) int64 {
+	fields := strings.Fields(val)
+	if len(fields) == 0 {
+		return 0
+	}
+
+	size, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return 0
+	}
+	if len(fields) > 1 {
+		switch fields[1] {
+		case "Bytes":
+			size = (size + 1024*1024 - 1) / (1024 * 1024)
+		case "KBytes":
+			size = (size + 1023) / 1024
+		case "GBytes":
+			size *= 1024
+		case "TBytes":
+			size *= 1024 * 1024
+		}
+	}
+	return size
+}
+
 func (vb *VBox) DeleteDisk(uuidOfFile string) error {
 	out, err := vb.manage("closemedium", uuidOfFile, "--delete")
 	if err != nil {
@@ -1,11 +1,13 @@
 package virtualbox
 
 import (
+	"context"
 	"io/ioutil"
 	"os"
 	"os/user"
 	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -95,3 +97,180 @@ Encryption:     disabled
 	}
 
 }
+
+func TestCloneDiskArgs(t *testing.T) {
+	src := &Disk{Path: "/vms/base.vdi", Type: HDDrive}
+
+	dst := &Disk{Path: "/vms/export.vmdk"}
+	args, err := cloneDiskArgs(src, dst, CloneOptions{Variants: []DiskVariant{DiskVariant_stream}})
+	if err != nil {
+		t.Fatalf("error building args %v", err)
+	}
+	expected := "clonemedium disk /vms/base.vdi /vms/export.vmdk --format VMDK --variant Stream"
+	if strings.Join(args, " ") != expected {
+		t.Errorf("expected %s, got %s", expected, strings.Join(args, " "))
+	}
+
+	dst = &Disk{Path: "/vms/vm1.vdi"}
+	if _, err := cloneDiskArgs(src, dst, CloneOptions{Variants: []DiskVariant{DiskVariant_split2g}}); err == nil {
+		t.Errorf("expected Split2G to be refused for VDI")
+	}
+
+	args, err = cloneDiskArgs(src, dst, CloneOptions{Variants: []DiskVariant{DiskVariant_fixed}, Existing: true})
+	if err != nil {
+		t.Fatalf("error building args %v", err)
+	}
+	expected = "clonemedium disk /vms/base.vdi /vms/vm1.vdi --format VDI --variant Fixed --existing"
+	if strings.Join(args, " ") != expected {
+		t.Errorf("expected %s, got %s", expected, strings.Join(args, " "))
+	}
+}
+
+func TestParseMBytes(t *testing.T) {
+	for val, expected := range map[string]int64{"1000 MBytes": 1000, "2 GBytes": 2048, "1 TBytes": 1048576,
+		"2048 KBytes": 2, "100 KBytes": 1, "3145728 Bytes": 3, "0 Bytes": 0, "": 0, "unknown": 0} {
+		if actual := parseMBytes(val); actual != expected {
+			t.Errorf("parsing %q expected %d, got %d", val, expected, actual)
+		}
+	}
+}
+
+func TestParseMediumInfo(t *testing.T) {
+	out := `UUID:           0e3f0c1b-f523-4a50-b1a8-d1e8c9a508b4
+Parent UUID:    base
+State:          created
+Type:           multiattach (base)
+Location:       /vms/base.vdi
+Storage format: VDI
+Format variant: dynamic default
+Capacity:       10240 MBytes
+Size on disk:   2048 MBytes
+Encryption:     disabled
+Property:       AllocationBlockSize=1048576
+Child UUIDs:    7a1b9f43-35c4-4a48-9f8e-5b0bcb5bd1c1
+                91d2a4c0-6c3f-4a8d-8f54-0d3a9a3fd1a2
+
+UUID:           7a1b9f43-35c4-4a48-9f8e-5b0bcb5bd1c1
+Parent UUID:    0e3f0c1b-f523-4a50-b1a8-d1e8c9a508b4
+State:          created
+Type:           normal (differencing)
+Location:       /vms/vm1/Snapshots/{7a1b9f43-35c4-4a48-9f8e-5b0bcb5bd1c1}.vdi
+Storage format: VDI
+Format variant: differencing default
+Capacity:       10240 MBytes
+Size on disk:   20 MBytes
+Encryption:     enabled
+In use by VMs:  vm1 (UUID: 3c1c5d2e-8a47-4b61-9a1e-4b2f0a5e7c11)
+                vm2 (UUID: 8d0e4f1a-2b3c-4d5e-8f90-a1b2c3d4e5f6) [snap1 (UUID: 11111111-2222-3333-4444-555555555555)]
+`
+
+	disks := parseMediumInfo(out)
+	if len(disks) != 2 {
+		t.Fatalf("expected 2 disks, got %d", len(disks))
+	}
+
+	base, child := disks[0], disks[1]
+	if base.ParentUUID != "" || base.MediumType != MediumType_multiattach || base.SizeMB != 10240 || base.SizeOnDiskMB != 2048 {
+		t.Errorf("base not parsed as expected, got %+v", base)
+	}
+	if len(base.ChildUUIDs) != 2 || base.ChildUUIDs[1] != "91d2a4c0-6c3f-4a8d-8f54-0d3a9a3fd1a2" {
+		t.Errorf("expected 2 child uuids, got %v", base.ChildUUIDs)
+	}
+	if base.Properties["AllocationBlockSize"] != "1048576" || base.Encrypted || len(base.InUseByVMs) != 0 {
+		t.Errorf("base not parsed as expected, got %+v", base)
+	}
+
+	if !reflect.DeepEqual(base.Variants, []DiskVariant{DiskVariant_standard}) || !reflect.DeepEqual(child.Variants, []DiskVariant{DiskVariant_diff}) {
+		t.Errorf("expected standard base and diff child variants, got %s and %s", base.Variants, child.Variants)
+	}
+
+	if child.ParentUUID != base.UUID || child.MediumType != MediumType_normal || !child.Encrypted || child.State != "created" {
+		t.Errorf("child not parsed as expected, got %+v", child)
+	}
+	expected := []string{"3c1c5d2e-8a47-4b61-9a1e-4b2f0a5e7c11", "8d0e4f1a-2b3c-4d5e-8f90-a1b2c3d4e5f6"}
+	if !reflect.DeepEqual(child.InUseByVMs, expected) {
+		t.Errorf("expected in use by %v, got %v", expected, child.InUseByVMs)
+	}
+}
+
+func TestVBox_CreateDiffDisk(t *testing.T) {
+	dirName, err := ioutil.TempDir("", "vbm")
+	if err != nil {
+		t.Fatalf("TempDir failed %v", err)
+	}
+	defer os.RemoveAll(dirName)
+
+	var vb VBox
+
+	base := &Disk{Path: filepath.Join(dirName, "base.vdi"), Format: VDI, SizeMB: 10, MediumType: MediumType_multiattach}
+	child := &Disk{Path: filepath.Join(dirName, "child.vdi"), Parent: base}
+
+	actual, err := vb.EnsureDisk(context.Background(), child)
+	if err != nil {
+		t.Fatalf("EnsureDisk failed %v", err)
+	}
+	defer vb.DeleteDisk(base.UUID)
+	defer vb.DeleteDisk(actual.UUID)
+
+	if actual.ParentUUID == "" || actual.ParentUUID != base.UUID {
+		t.Errorf("expected child of %s, got parent %s", base.UUID, actual.ParentUUID)
+	}
+
+	info, err := vb.DiskInfo(base)
+	if err != nil {
+		t.Fatalf("DiskInfo failed %v", err)
+	}
+	if info.MediumType != MediumType_multiattach {
+		t.Errorf("expected base to be multiattach, got %s", info.MediumType)
+	}
+}
+
+func TestRawDiskVMDKArgs(t *testing.T) {
+	args := rawDiskVMDKArgs(7, "/vms/vm1/sdb.vmdk", "/dev/sdb", []int{1, 3})
+	expected := "createmedium disk --filename /vms/vm1/sdb.vmdk --format VMDK --variant RawDisk --property RawDrive=/dev/sdb --property Partitions=1,3"
+	if strings.Join(args, " ") != expected {
+		t.Errorf("expected %s, got %s", expected, strings.Join(args, " "))
+	}
+
+	args = rawDiskVMDKArgs(6, "/vms/vm1/loop0.vmdk", "/dev/loop0", nil)
+	expected = "internalcommands createrawvmdk -filename /vms/vm1/loop0.vmdk -rawdisk /dev/loop0"
+	if strings.Join(args, " ") != expected {
+		t.Errorf("expected %s, got %s", expected, strings.Join(args, " "))
+	}
+}
+
+func TestCreateDiskArgs(t *testing.T) {
+	disk := &Disk{Path: "/vms/vm1/disk1.vmdk", SizeMB: 1024, Format: VMDK, Variants: []DiskVariant{DiskVariant_fixed, DiskVariant_split2g},
+		Properties: map[string]string{"b": "2", "a": "1"}}
+
+	args, err := createDiskArgs(disk)
+	if err != nil {
+		t.Fatalf("error building args %v", err)
+	}
+	expected := "createmedium disk --filename /vms/vm1/disk1.vmdk --size 1024 --format VMDK --variant Fixed,Split2G --property a=1 --property b=2"
+	if strings.Join(args, " ") != expected {
+		t.Errorf("expected %s, got %s", expected, strings.Join(args, " "))
+	}
+
+	if _, err := createDiskArgs(&Disk{Path: "/vms/vm1/disk1.vdi", SizeMB: 1024, Variants: []DiskVariant{DiskVariant_split2g}}); err == nil {
+		t.Errorf("expected Split2G to be refused for VDI")
+	}
+
+	var vb VBox
+	if err := vb.CreateDisk(&Disk{Path: "/vms/vm1/disk2.vdi", Variants: []DiskVariant{DiskVariant_diff}}); err == nil {
+		t.Errorf("expected a diff disk without parent to be refused")
+	}
+
+	for val, expected := range map[string][]DiskVariant{
+		"dynamic default":         {DiskVariant_standard},
+		"fixed default":           {DiskVariant_fixed},
+		"dynamic vmdk split2G":    {DiskVariant_split2g},
+		"fixed vmdk split2G":      {DiskVariant_fixed, DiskVariant_split2g},
+		"dynamic streamOptimized": {DiskVariant_stream},
+		"differencing default":    {DiskVariant_diff},
+	} {
+		if actual := parseDiskVariants(val); !reflect.DeepEqual(actual, expected) {
+			t.Errorf("parsing %q expected %s, got %s", val, expected, actual)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package virtualbox
+
+import (
+	"fmt"
+	"strings"
+)
+
+// DiskCipher is the cipher a disk is encrypted with, encryption needs the VirtualBox extension pack
+type DiskCipher string
+
+const (
+	Cipher_AES128 = DiskCipher("AES-XTS128-PLAIN64")
+	Cipher_AES256 = DiskCipher("AES-XTS256-PLAIN64")
+)
+
+// DiskEncryption encrypts a disk at rest. The password is read from PasswordFile and is known to running vms
+// by PasswordID, disks sharing an id share the password
+type DiskEncryption struct {
+	// Cipher defaults to Cipher_AES256
+	Cipher       DiskCipher
+	PasswordID   string
+	PasswordFile string
+}
+
+// EncryptDisk encrypts disk with the password in passwordFile. Disks already encrypted have to be decrypted
+// first, see DecryptDisk
+func (vb *VBox) EncryptDisk(disk *Disk, cipher DiskCipher, passwordID, passwordFile string) error {
+	if cipher == "" {
+		cipher = Cipher_AES256
+	}
+	_, err := vb.manage("encryptmedium", disk.UUIDorPath(), "--newpassword", passwordFile,
+		"--cipher", string(cipher), "--newpasswordid", passwordID)
+	return err
+}
+
+// DecryptDisk decrypts disk with the password in passwordFile
+func (vb *VBox) DecryptDisk(disk *Disk, passwordFile string) error {
+	_, err := vb.manage("encryptmedium", disk.UUIDorPath(), "--oldpassword", passwordFile)
+	return err
+}
+
+// CheckMediumPassword reports whether the password in passwordFile decrypts disk
+func (vb *VBox) CheckMediumPassword(disk *Disk, passwordFile string) (bool, error) {
+	_, err := vb.manage("checkmediumpwd", disk.UUIDorPath(), passwordFile)
+	if err != nil && strings.Contains(strings.ToLower(err.Error()), "password is incorrect") {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// AddEncryptionPassword hands the password of the disks encrypted with passwordID to a running vm, vms with
+// encrypted disks stay paused until all passwords are known. The password is forgotten when the vm is
+// suspended if removeOnSuspend is set
+func (vb *VBox) AddEncryptionPassword(vm *VirtualMachine, passwordID, passwordFile string, removeOnSuspend bool) error {
+	remove := "no"
+	if removeOnSuspend {
+		remove = "yes"
+	}
+	_, err := vb.control(vm, "addencpassword", passwordID, passwordFile, "--removeonsuspend", remove)
+	return err
+}
+
+// encryptionPasswords returns the passwords needed by the encrypted disks of vm, one per password id
+func encryptionPasswords(vm *VirtualMachine) []DiskEncryption {
+	var passwords []DiskEncryption
+	seen := map[string]bool{}
+	for _, d := range vm.Spec.Disks {
+		if d.Encryption == nil || seen[d.Encryption.PasswordID] {
+			continue
+		}
+		seen[d.Encryption.PasswordID] = true
+		passwords = append(passwords, *d.Encryption)
+	}
+	return passwords
+}
+
+// validateEncryption checks that encrypted disks name a password id and file, and that disks sharing a password
+// id read the password from the same file
+func validateEncryption(disks []Disk, verr *ValidationErrors) {
+	files := map[string]string{}
+	for i, d := range disks {
+		enc := d.Encryption
+		if enc == nil {
+			continue
+		}
+		path := fmt.Sprintf("disk/%d/encryption", i)
+		if enc.PasswordID == "" {
+			verr.Add(path, fmt.Errorf("password id is empty"))
+		}
+		if enc.PasswordFile == "" {
+			verr.Add(path, fmt.Errorf("password file is empty"))
+		}
+		if enc.PasswordID == "" || enc.PasswordFile == "" {
+			continue
+		}
+		if file, ok := files[enc.PasswordID]; ok && file != enc.PasswordFile {
+			verr.Add(path, fmt.Errorf("password id %s is read from %s by another disk, got %s", enc.PasswordID, file, enc.PasswordFile))
+			continue
+		}
+		files[enc.PasswordID] = enc.PasswordFile
+	}
+}
@@ -0,0 +1,42 @@
+package virtualbox
+
+import (
+	"testing"
+)
+
+func TestEncryptionPasswords(t *testing.T) {
+	vm := &VirtualMachine{}
+	vm.Spec.Disks = []Disk{
+		{Path: "disk1.vdi", Encryption: &DiskEncryption{PasswordID: "data", PasswordFile: "/secrets/data"}},
+		{Path: "disk2.vdi"},
+		{Path: "disk3.vdi", Encryption: &DiskEncryption{PasswordID: "data", PasswordFile: "/secrets/data"}},
+		{Path: "disk4.vdi", Encryption: &DiskEncryption{PasswordID: "os", PasswordFile: "/secrets/os"}},
+	}
+
+	passwords := encryptionPasswords(vm)
+	if len(passwords) != 2 || passwords[0].PasswordID != "data" || passwords[1].PasswordID != "os" {
+		t.Errorf("expected one password per id, got %+v", passwords)
+	}
+}
+
+func TestValidateEncryption(t *testing.T) {
+	disks := []Disk{
+		{Path: "disk1.vdi", Encryption: &DiskEncryption{PasswordID: "data", PasswordFile: "/secrets/data"}},
+		{Path: "disk2.vdi", Encryption: &DiskEncryption{PasswordID: "data", PasswordFile: "/secrets/data"}},
+		{Path: "disk3.vdi", Encryption: &DiskEncryption{PasswordID: "data", PasswordFile: "/secrets/other"}},
+		{Path: "disk4.vdi", Encryption: &DiskEncryption{PasswordFile: "/secrets/os"}},
+		{Path: "disk5.vdi", Encryption: &DiskEncryption{PasswordID: "os"}},
+		{Path: "disk6.vdi"},
+	}
+
+	var verr ValidationErrors
+	validateEncryption(disks, &verr)
+	if len(verr.errors) != 3 {
+		t.Fatalf("expected 3 validation errors, got %d: %v", len(verr.errors), verr)
+	}
+	for i, path := range []string{"disk/2/encryption", "disk/3/encryption", "disk/4/encryption"} {
+		if verr.errors[i].Path != path {
+			t.Errorf("expected error %d at %s, got %s", i, path, verr.errors[i].Path)
+		}
+	}
+}
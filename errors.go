@@ -40,7 +40,7 @@ func (v ValidationErrors) Error() string {
 
 	return strings.Join(messages, "\n")
 }
-func (v ValidationErrors) Add(path string, err error) {
+func (v *ValidationErrors) Add(path string, err error) {
 	v.errors = append(v.errors, ValidationError{path, err})
 }
 
@@ -80,3 +80,8 @@ type NotFoundError string
 func (n NotFoundError) Error() string {
 	return string(n)
 }
+
+func IsNotFoundError(err error) bool {
+	_, ok := err.(NotFoundError)
+	return ok
+}
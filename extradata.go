@@ -0,0 +1,42 @@
+package virtualbox
+
+import (
+	"regexp"
+	"strings"
+)
+
+// parses lines like the following, as printed by getextradata enumerate
+//  Key: virtualbox-go/networks/hostonly/vboxnet0, Value: vboxnet0
+var reExtraDataLine = regexp.MustCompile(`Key:\s+([^,]+),\s+Value:\s*(.*)`)
+
+func (vb *VBox) setGlobalExtraData(key, val string) error {
+	_, err := vb.manage("setextradata", "global", key, val)
+	return err
+}
+
+// deleteGlobalExtraData removes the key, setting extradata without a value deletes it
+func (vb *VBox) deleteGlobalExtraData(key string) error {
+	_, err := vb.manage("setextradata", "global", key)
+	return err
+}
+
+// globalExtraData returns all the global extradata entries whose key starts with prefix
+func (vb *VBox) globalExtraData(prefix string) (map[string]string, error) {
+	out, err := vb.manage("getextradata", "global", "enumerate")
+	if err != nil {
+		return nil, err
+	}
+
+	m := make(map[string]string)
+	err = parseKeyValues(out, reExtraDataLine, func(key, val string) error {
+		if strings.HasPrefix(key, prefix) {
+			m[key] = val
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
@@ -0,0 +1,465 @@
+package virtualbox
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+const (
+	// ipamStateFile is kept under Config.BasePath
+	ipamStateFile = "virtualbox-go-ipam.json"
+
+	// ipamFirstHostOffset leaves the low addresses of a subnet to the host, gateways and dhcp servers.
+	// Static addresses are handed out from there up to the middle of the subnet, the upper half is left
+	// to the dynamic range of the dhcp server
+	ipamFirstHostOffset = 10
+
+	defaultSubnetPrefixLen = 24
+)
+
+// IPAMConfig enables address management for Config.Networks
+type IPAMConfig struct {
+	// Supernet is carved into subnets for networks that do not declare an IPNet
+	Supernet net.IPNet
+	// SubnetPrefixLen is the prefix length of carved subnets, defaults to 24
+	SubnetPrefixLen int
+}
+
+// IPAllocation is a static address handed out to a nic of a vm
+type IPAllocation struct {
+	Network string
+	VM      string
+	NIC     int
+	IP      string
+}
+
+type ipamState struct {
+	// Subnets maps network names to their cidr
+	Subnets     map[string]string
+	Allocations []IPAllocation
+}
+
+func (vb *VBox) ipamStatePath() string {
+	return filepath.Join(vb.Config.BasePath, ipamStateFile)
+}
+
+func (vb *VBox) loadIPAMState() (*ipamState, error) {
+	state := &ipamState{Subnets: map[string]string{}}
+
+	data, err := ioutil.ReadFile(vb.ipamStatePath())
+	if os.IsNotExist(err) {
+		return state, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("corrupt ipam state %s: %v", vb.ipamStatePath(), err)
+	}
+	if state.Subnets == nil {
+		state.Subnets = map[string]string{}
+	}
+	return state, nil
+}
+
+// saveIPAMState writes the state to a temp file first so a crash never leaves a truncated state behind
+func (vb *VBox) saveIPAMState(state *ipamState) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(vb.Config.BasePath, os.ModePerm); err != nil {
+		return err
+	}
+
+	tmp := vb.ipamStatePath() + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, vb.ipamStatePath())
+}
+
+// AllocateSubnet assigns nw.IPNet from the IPAM supernet, networks declaring their own IPNet have it recorded
+// as is. The allocation is keyed by the network name, so the same subnet is handed back on subsequent calls.
+// Subnets already in use by networks on the host are skipped
+func (vb *VBox) AllocateSubnet(nw *Network) error {
+	if vb.Config.IPAM == nil {
+		return fmt.Errorf("ipam is not configured")
+	}
+
+	vb.ipamLock.Lock()
+	defer vb.ipamLock.Unlock()
+
+	state, err := vb.loadIPAMState()
+	if err != nil {
+		return err
+	}
+
+	if nw.IPNet.IP != nil {
+		subnet := net.IPNet{IP: nw.IPNet.IP.Mask(nw.IPNet.Mask), Mask: nw.IPNet.Mask}
+		if state.Subnets[nw.Name] == subnet.String() {
+			return nil
+		}
+		state.Subnets[nw.Name] = subnet.String()
+		return vb.saveIPAMState(state)
+	}
+
+	if cidr, ok := state.Subnets[nw.Name]; ok {
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return err
+		}
+		setNetworkSubnet(nw, *ipnet)
+		return nil
+	}
+
+	var used []net.IPNet
+	for _, cidr := range state.Subnets {
+		if _, ipnet, err := net.ParseCIDR(cidr); err == nil {
+			used = append(used, *ipnet)
+		}
+	}
+	for _, n := range vb.networks().All() {
+		if n.IPNet.IP != nil && n.IPNet.Mask != nil {
+			used = append(used, n.IPNet)
+		}
+	}
+
+	subnet, err := nextFreeSubnet(vb.Config.IPAM.Supernet, vb.Config.IPAM.prefixLen(), used)
+	if err != nil {
+		return err
+	}
+
+	state.Subnets[nw.Name] = subnet.String()
+	if err := vb.saveIPAMState(state); err != nil {
+		return err
+	}
+	setNetworkSubnet(nw, subnet)
+	return nil
+}
+
+// renameSubnet moves the subnet and allocations of a network, used when virtualbox names a hostonly
+// interface differently from its declaration
+func (vb *VBox) renameSubnet(from, to string) error {
+	vb.ipamLock.Lock()
+	defer vb.ipamLock.Unlock()
+
+	state, err := vb.loadIPAMState()
+	if err != nil {
+		return err
+	}
+
+	cidr, ok := state.Subnets[from]
+	if !ok {
+		return nil
+	}
+	delete(state.Subnets, from)
+	state.Subnets[to] = cidr
+	for i := range state.Allocations {
+		if state.Allocations[i].Network == from {
+			state.Allocations[i].Network = to
+		}
+	}
+
+	return vb.saveIPAMState(state)
+}
+
+// ReleaseSubnet forgets the subnet of the named network along with all addresses allocated in it
+func (vb *VBox) ReleaseSubnet(name string) error {
+	vb.ipamLock.Lock()
+	defer vb.ipamLock.Unlock()
+
+	state, err := vb.loadIPAMState()
+	if err != nil {
+		return err
+	}
+
+	delete(state.Subnets, name)
+	allocs := state.Allocations[:0]
+	for _, a := range state.Allocations {
+		if a.Network != name {
+			allocs = append(allocs, a)
+		}
+	}
+	state.Allocations = allocs
+
+	return vb.saveIPAMState(state)
+}
+
+// AssignIPs hands out a static address to every nic of vm attached to a network with an IPAM subnet and
+// registers it as a fixed address with the dhcp server of that network. Nics that already hold an
+// allocation keep their address. Nics on networks whose dhcp server cannot hold fixed addresses, like
+// hostonlynets, are refused
+func (vb *VBox) AssignIPs(vm *VirtualMachine) ([]IPAllocation, error) {
+	vb.ipamLock.Lock()
+	defer vb.ipamLock.Unlock()
+
+	state, err := vb.loadIPAMState()
+	if err != nil {
+		return nil, err
+	}
+
+	var assigned []IPAllocation
+	dhcpConfigs := map[string]*DHCPServerConfig{}
+
+	for _, nic := range vm.Spec.NICs {
+		cidr, ok := state.Subnets[nic.NetworkName]
+		if !ok {
+			continue
+		}
+		_, subnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+
+		path := fmt.Sprintf("nic/%d", nic.Index)
+
+		// an address that cannot be registered as fixed could be leased to another vm
+		config, ok := dhcpConfigs[nic.NetworkName]
+		if !ok {
+			config = ipamDHCPServerConfig(nic.Mode, nic.NetworkName, *subnet)
+			if config == nil {
+				return nil, OperationError{Path: path, Op: "allocate",
+					Err: fmt.Errorf("static addresses cannot be registered with the dhcp server of %s network %s", nic.Mode, nic.NetworkName)}
+			}
+			dhcpConfigs[nic.NetworkName] = config
+		}
+
+		alloc, err := state.allocate(*subnet, nic.NetworkName, vm.Spec.Name, nic.Index)
+		if err != nil {
+			return nil, OperationError{Path: path, Op: "allocate", Err: err}
+		}
+		assigned = append(assigned, alloc)
+
+		config.VMs = append(config.VMs, DHCPVMConfig{VM: vm.Spec.Name, NIC: nic.Index, FixedAddress: alloc.IP})
+	}
+
+	if err := vb.saveIPAMState(state); err != nil {
+		return nil, err
+	}
+
+	for name, config := range dhcpConfigs {
+		if err := vb.EnsureDHCPServer(config); err != nil {
+			return assigned, OperationError{Path: "dhcpserver/" + name, Op: "ensure", Err: err}
+		}
+	}
+
+	return assigned, nil
+}
+
+// ReleaseIPs returns all addresses held by vm to the pool and removes the fixed addresses AssignIPs
+// registered with the dhcp servers
+func (vb *VBox) ReleaseIPs(vm *VirtualMachine) error {
+	vb.ipamLock.Lock()
+	defer vb.ipamLock.Unlock()
+
+	state, err := vb.loadIPAMState()
+	if err != nil {
+		return err
+	}
+
+	dhcpConfigs := map[string]*DHCPServerConfig{}
+	allocs := state.Allocations[:0]
+	for _, a := range state.Allocations {
+		if a.VM != vm.Spec.Name {
+			allocs = append(allocs, a)
+			continue
+		}
+
+		config, ok := dhcpConfigs[a.Network]
+		if !ok {
+			config = releaseDHCPServerConfig(vb.allocationMode(vm, a), a.Network)
+			if config == nil {
+				continue
+			}
+			dhcpConfigs[a.Network] = config
+		}
+		config.VMs = append(config.VMs, DHCPVMConfig{VM: vm.Spec.Name, NIC: a.NIC, Remove: true})
+	}
+	state.Allocations = allocs
+
+	if err := vb.saveIPAMState(state); err != nil {
+		return err
+	}
+
+	for name, config := range dhcpConfigs {
+		if err := vb.ModifyDHCPServer(config); err != nil {
+			return OperationError{Path: "dhcpserver/" + name, Op: "release", Err: err}
+		}
+	}
+	return nil
+}
+
+// allocationMode returns the mode of the network an allocation was made on, taken from the nic of vm holding
+// it or else from the known networks
+func (vb *VBox) allocationMode(vm *VirtualMachine, a IPAllocation) NetworkMode {
+	for _, nic := range vm.Spec.NICs {
+		if nic.Index == a.NIC && nic.NetworkName == a.Network {
+			return nic.Mode
+		}
+	}
+	for _, nw := range vb.networks().ByName(a.Network) {
+		if nw.Mode == NWMode_hostonly || nw.Mode == NWMode_natnetwork {
+			return nw.Mode
+		}
+	}
+	return ""
+}
+
+// IPAllocations lists the addresses handed out on the named network, sorted by address
+func (vb *VBox) IPAllocations(network string) ([]IPAllocation, error) {
+	vb.ipamLock.Lock()
+	defer vb.ipamLock.Unlock()
+
+	state, err := vb.loadIPAMState()
+	if err != nil {
+		return nil, err
+	}
+
+	var allocs []IPAllocation
+	for _, a := range state.Allocations {
+		if a.Network == network {
+			allocs = append(allocs, a)
+		}
+	}
+	sort.Slice(allocs, func(i, j int) bool {
+		return ipLess(net.ParseIP(allocs[i].IP), net.ParseIP(allocs[j].IP))
+	})
+	return allocs, nil
+}
+
+func (s *ipamState) allocate(subnet net.IPNet, network, vm string, nic int) (IPAllocation, error) {
+	taken := map[string]bool{}
+	for _, a := range s.Allocations {
+		if a.Network != network {
+			continue
+		}
+		if a.VM == vm && a.NIC == nic {
+			return a, nil
+		}
+		taken[a.IP] = true
+	}
+
+	dynamic := dynamicRangeStart(subnet)
+	for ip := ipAdd(subnet.IP, ipamFirstHostOffset); ipLess(ip, dynamic); ip = ipAdd(ip, 1) {
+		if !taken[ip.String()] {
+			a := IPAllocation{Network: network, VM: vm, NIC: nic, IP: ip.String()}
+			s.Allocations = append(s.Allocations, a)
+			return a, nil
+		}
+	}
+	return IPAllocation{}, fmt.Errorf("subnet %s of network %s is exhausted", subnet.String(), network)
+}
+
+func (c *IPAMConfig) prefixLen() int {
+	if c.SubnetPrefixLen == 0 {
+		return defaultSubnetPrefixLen
+	}
+	return c.SubnetPrefixLen
+}
+
+// nextFreeSubnet returns the first subnet of the given prefix length within supernet not overlapping used
+func nextFreeSubnet(supernet net.IPNet, prefixLen int, used []net.IPNet) (net.IPNet, error) {
+	ones, bits := supernet.Mask.Size()
+	if prefixLen < ones || prefixLen > bits {
+		return net.IPNet{}, fmt.Errorf("cannot carve /%d subnets from %s", prefixLen, supernet.String())
+	}
+
+	mask := net.CIDRMask(prefixLen, bits)
+	candidate := net.IPNet{IP: supernet.IP.Mask(supernet.Mask), Mask: mask}
+	if bits == 32 {
+		candidate.IP = candidate.IP.To4()
+	}
+
+	for supernet.Contains(candidate.IP) {
+		free := true
+		for _, u := range used {
+			if u.Contains(candidate.IP) || candidate.Contains(u.IP.Mask(u.Mask)) {
+				free = false
+				break
+			}
+		}
+		if free {
+			return candidate, nil
+		}
+
+		next := ipAdd(broadcastIP(candidate), 1)
+		if ipLess(next, candidate.IP) { // wrapped around the address space
+			break
+		}
+		candidate.IP = next
+	}
+
+	return net.IPNet{}, fmt.Errorf("supernet %s is exhausted", supernet.String())
+}
+
+// setNetworkSubnet fills in nw.IPNet for subnet. Hostonly interfaces take the first address of the
+// subnet as the host address, other networks are described by the subnet itself
+func setNetworkSubnet(nw *Network, subnet net.IPNet) {
+	if nw.Mode == NWMode_hostonly {
+		nw.IPNet = net.IPNet{IP: ipAdd(subnet.IP, 1), Mask: subnet.Mask}
+	} else {
+		nw.IPNet = subnet
+	}
+}
+
+// ipamDHCPServerConfig describes the dhcp server serving an IPAM subnet, the dynamic range is kept
+// clear of the static addresses at the start of the subnet. Networks whose dhcp server cannot be
+// configured through dhcpserver get nil, e.g hostonlynets which are served by the dhcp of the macOS host
+func ipamDHCPServerConfig(mode NetworkMode, name string, subnet net.IPNet) *DHCPServerConfig {
+	config := &DHCPServerConfig{
+		IPAddress:      ipAdd(subnet.IP, 2).String(),
+		NetworkMask:    net.IP(subnet.Mask).String(),
+		LowerIPAddress: dynamicRangeStart(subnet).String(),
+		UpperIPAddress: ipAdd(broadcastIP(subnet), -1).String(),
+		Enabled:        BoolPtr(true),
+	}
+
+	switch mode {
+	case NWMode_hostonly:
+		config.Interface = name
+	case NWMode_natnetwork:
+		config.NetworkName = name
+	default:
+		return nil
+	}
+	return config
+}
+
+// releaseDHCPServerConfig targets the dhcp server of an IPAM subnet without changing its settings, nil for
+// networks whose dhcp server cannot be configured through dhcpserver
+func releaseDHCPServerConfig(mode NetworkMode, name string) *DHCPServerConfig {
+	switch mode {
+	case NWMode_hostonly:
+		return &DHCPServerConfig{Interface: name}
+	case NWMode_natnetwork:
+		return &DHCPServerConfig{NetworkName: name}
+	}
+	return nil
+}
+
+// dynamicRangeStart returns the middle address of subnet
+func dynamicRangeStart(subnet net.IPNet) net.IP {
+	ones, bits := subnet.Mask.Size()
+	hostBits := uint(bits - ones)
+	if hostBits > 62 {
+		hostBits = 62
+	}
+	return ipAdd(subnet.IP.Mask(subnet.Mask), int64(1)<<(hostBits-1))
+}
+
+func ipLess(a, b net.IP) bool {
+	a16, b16 := a.To16(), b.To16()
+	for i := range a16 {
+		if a16[i] != b16[i] {
+			return a16[i] < b16[i]
+		}
+	}
+	return false
+}
@@ -0,0 +1,96 @@
+package virtualbox
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+)
+
+func TestNextFreeSubnet(t *testing.T) {
+	_, supernet, _ := net.ParseCIDR("10.100.0.0/16")
+	_, used1, _ := net.ParseCIDR("10.100.0.0/24")
+	_, used2, _ := net.ParseCIDR("10.100.1.1/24")
+
+	subnet, err := nextFreeSubnet(*supernet, 24, []net.IPNet{*used1, *used2})
+	if err != nil {
+		t.Fatalf("error carving subnet %v", err)
+	}
+	if subnet.String() != "10.100.2.0/24" {
+		t.Errorf("expected 10.100.2.0/24, got %s", subnet.String())
+	}
+
+	_, small, _ := net.ParseCIDR("10.100.0.0/23")
+	if _, err := nextFreeSubnet(*small, 24, []net.IPNet{*used1, *used2}); err == nil {
+		t.Errorf("expected supernet to be exhausted")
+	}
+}
+
+func TestVBox_IPAM(t *testing.T) {
+	dirName, err := ioutil.TempDir("", "vbm")
+	if err != nil {
+		t.Fatalf("Tempdir creation failed %v", err)
+	}
+	defer os.RemoveAll(dirName)
+
+	_, supernet, _ := net.ParseCIDR("10.100.0.0/16")
+
+	// Object under test
+	vb := NewVBox(Config{
+		BasePath: dirName,
+		IPAM:     &IPAMConfig{Supernet: *supernet},
+	})
+
+	nw := &Network{Name: "labnet", Mode: NWMode_natnetwork}
+	if err := vb.AllocateSubnet(nw); err != nil {
+		t.Fatalf("error allocating subnet %v", err)
+	}
+	if nw.IPNet.String() != "10.100.0.0/24" {
+		t.Errorf("expected 10.100.0.0/24, got %s", nw.IPNet.String())
+	}
+
+	// allocations survive a new instance through the state file
+	vb = NewVBox(vb.Config)
+	again := &Network{Name: "labnet", Mode: NWMode_natnetwork}
+	if err := vb.AllocateSubnet(again); err != nil || again.IPNet.String() != nw.IPNet.String() {
+		t.Errorf("expected the same subnet, got %s, %v", again.IPNet.String(), err)
+	}
+
+	state, err := vb.loadIPAMState()
+	if err != nil {
+		t.Fatalf("error loading state %v", err)
+	}
+	a1, _ := state.allocate(nw.IPNet, "labnet", "vm01", 1)
+	a2, _ := state.allocate(nw.IPNet, "labnet", "vm02", 1)
+	if a1.IP != "10.100.0.10" || a2.IP != "10.100.0.11" {
+		t.Errorf("expected sequential addresses, got %s and %s", a1.IP, a2.IP)
+	}
+	if a, _ := state.allocate(nw.IPNet, "labnet", "vm01", 1); a.IP != a1.IP {
+		t.Errorf("expected the same address for the same nic, got %s", a.IP)
+	}
+	if err := vb.saveIPAMState(state); err != nil {
+		t.Fatalf("error saving state %v", err)
+	}
+
+	if err := vb.ReleaseIPs(&VirtualMachine{Spec: VirtualMachineSpec{Name: "vm01"}}); err != nil {
+		t.Fatalf("error releasing %v", err)
+	}
+	allocs, err := vb.IPAllocations("labnet")
+	if err != nil || len(allocs) != 1 || allocs[0].VM != "vm02" {
+		t.Errorf("expected only vm02 to hold an address, got %#v, %v", allocs, err)
+	}
+
+	// hostonlynets are served by the dhcp of the host, which cannot hold fixed addresses
+	hostnet := &Network{Name: "hostnet", Mode: NWMode_hostonlynet}
+	if err := vb.AllocateSubnet(hostnet); err != nil {
+		t.Fatalf("error allocating subnet %v", err)
+	}
+	vm := &VirtualMachine{Spec: VirtualMachineSpec{Name: "vm03",
+		NICs: []NIC{{Index: 1, Mode: NWMode_hostonlynet, NetworkName: "hostnet"}}}}
+	if _, err := vb.AssignIPs(vm); err == nil {
+		t.Errorf("expected static addresses on a hostonlynet to be refused")
+	}
+	if allocs, _ := vb.IPAllocations("hostnet"); len(allocs) != 0 {
+		t.Errorf("expected no address allocated on hostnet, got %#v", allocs)
+	}
+}
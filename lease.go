@@ -0,0 +1,144 @@
+package virtualbox
+
+import (
+	"encoding/xml"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const leaseFileSuffix = "-Dhcpd.leases"
+
+// DHCPLease is an address handed out by a virtualbox dhcp server
+type DHCPLease struct {
+	MAC    string
+	IP     net.IP
+	State  string // e.g acked, offered, released
+	Expiry time.Time
+}
+
+// NICAddress joins a nic of a vm with the lease it currently holds
+type NICAddress struct {
+	NIC   NIC
+	Lease DHCPLease
+}
+
+// leasesXML maps the lease files written by VBoxNetDHCP, which look like the following
+//  <Leases version="1.0">
+//    <Lease mac="08:00:27:c2:4f:10" id="0108002..." state="acked">
+//      <Address value="192.168.56.101"/>
+//      <Time issued="1541452230" expiration="600"/>
+//    </Lease>
+//  </Leases>
+type leasesXML struct {
+	Leases []struct {
+		MAC     string `xml:"mac,attr"`
+		State   string `xml:"state,attr"`
+		Address struct {
+			Value string `xml:"value,attr"`
+		} `xml:"Address"`
+		Time struct {
+			Issued     int64 `xml:"issued,attr"`
+			Expiration int64 `xml:"expiration,attr"`
+		} `xml:"Time"`
+	} `xml:"Lease"`
+}
+
+// Leases reads the leases of the dhcp server of networkName. networkName is the dhcp network name as listed
+// by ListDHCPServers, hostonly interface names like vboxnet0 are accepted as well
+func (vb *VBox) Leases(networkName string) ([]DHCPLease, error) {
+	dir := vboxUserHome()
+
+	path := filepath.Join(dir, networkName+leaseFileSuffix)
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		path = filepath.Join(dir, "HostInterfaceNetworking-"+networkName+leaseFileSuffix)
+	}
+
+	leases, err := readLeaseFile(path)
+	if os.IsNotExist(err) {
+		return nil, NotFoundError("no dhcp leases found for " + networkName)
+	}
+	return leases, err
+}
+
+// VMAddresses returns the leased addresses of the nics of vm, nics without an active lease are left out. When a
+// nic holds several leases the one expiring last wins
+func (vb *VBox) VMAddresses(vm *VirtualMachine) ([]NICAddress, error) {
+	info, err := vb.VMInfo(vm.UUIDOrName())
+	if err != nil {
+		return nil, err
+	}
+
+	files, err := filepath.Glob(filepath.Join(vboxUserHome(), "*"+leaseFileSuffix))
+	if err != nil {
+		return nil, err
+	}
+
+	var leases []DHCPLease
+	for _, f := range files {
+		l, err := readLeaseFile(f)
+		if err != nil {
+			return nil, err
+		}
+		leases = append(leases, l...)
+	}
+	byMAC := activeLeases(leases, time.Now())
+
+	var addrs []NICAddress
+	for _, nic := range info.Spec.NICs {
+		if l, ok := byMAC[normalizeMAC(nic.MAC)]; ok {
+			addrs = append(addrs, NICAddress{NIC: nic, Lease: l})
+		}
+	}
+	return addrs, nil
+}
+
+// activeLeases keys the acked leases that have not expired by now by normalized mac, keeping the one expiring
+// last for each mac
+func activeLeases(leases []DHCPLease, now time.Time) map[string]DHCPLease {
+	byMAC := map[string]DHCPLease{}
+	for _, l := range leases {
+		if l.State != "acked" || l.Expiry.Before(now) {
+			continue
+		}
+		mac := normalizeMAC(l.MAC)
+		if cur, ok := byMAC[mac]; !ok || l.Expiry.After(cur.Expiry) {
+			byMAC[mac] = l
+		}
+	}
+	return byMAC
+}
+
+func readLeaseFile(path string) ([]DHCPLease, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseLeases(data)
+}
+
+func parseLeases(data []byte) ([]DHCPLease, error) {
+	var doc leasesXML
+	if err := xml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+
+	leases := make([]DHCPLease, 0, len(doc.Leases))
+	for _, l := range doc.Leases {
+		leases = append(leases, DHCPLease{
+			MAC:    l.MAC,
+			IP:     net.ParseIP(l.Address.Value),
+			State:  l.State,
+			Expiry: time.Unix(l.Time.Issued+l.Time.Expiration, 0),
+		})
+	}
+	return leases, nil
+}
+
+// normalizeMAC brings macs to the form used by showvminfo, e.g 080027c24f10
+func normalizeMAC(mac string) string {
+	return strings.ToLower(strings.NewReplacer(":", "", "-", "").Replace(mac))
+}
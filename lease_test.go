@@ -0,0 +1,58 @@
+package virtualbox
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseLeases(t *testing.T) {
+	var sampleLeases = `<?xml version="1.0"?>
+<Leases version="1.0">
+  <Lease mac="08:00:27:c2:4f:10" id="010800274fc210" state="acked">
+    <Address value="192.168.56.101"/>
+    <Time issued="1541452230" expiration="600"/>
+  </Lease>
+  <Lease mac="08:00:27:9a:01:02" id="010800279a0102" state="released">
+    <Address value="192.168.56.102"/>
+    <Time issued="1541450000" expiration="600"/>
+  </Lease>
+</Leases>
+`
+
+	leases, err := parseLeases([]byte(sampleLeases))
+	if err != nil {
+		t.Fatalf("error parsing leases %v", err)
+	}
+
+	if len(leases) != 2 {
+		t.Fatalf("expected 2 leases, got %#v", leases)
+	}
+
+	l := leases[0]
+	if normalizeMAC(l.MAC) != "080027c24f10" || l.IP.String() != "192.168.56.101" || l.State != "acked" {
+		t.Errorf("lease not parsed as expected, got %#v", l)
+	}
+
+	if !l.Expiry.Equal(time.Unix(1541452830, 0)) {
+		t.Errorf("expected expiry at issued+expiration, got %v", l.Expiry)
+	}
+}
+
+func TestActiveLeases(t *testing.T) {
+	now := time.Unix(1541452300, 0)
+	leases := []DHCPLease{
+		{MAC: "08:00:27:C2:4F:10", State: "acked", Expiry: now.Add(time.Minute)},
+		{MAC: "08:00:27:c2:4f:10", State: "acked", Expiry: now.Add(time.Hour)},
+		{MAC: "08:00:27:9a:01:02", State: "released", Expiry: now.Add(time.Hour)},
+		{MAC: "08:00:27:9a:01:03", State: "offered", Expiry: now.Add(time.Hour)},
+		{MAC: "08:00:27:9a:01:04", State: "acked", Expiry: now.Add(-time.Minute)},
+	}
+
+	active := activeLeases(leases, now)
+	if len(active) != 1 {
+		t.Fatalf("expected only the acked unexpired lease, got %#v", active)
+	}
+	if l := active["080027c24f10"]; !l.Expiry.Equal(now.Add(time.Hour)) {
+		t.Errorf("expected the lease expiring last, got %#v", l)
+	}
+}
@@ -0,0 +1,112 @@
+package virtualbox
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+)
+
+// DefaultOUI is the vendor prefix virtualbox itself assigns macs from
+const DefaultOUI = "08:00:27"
+
+// maxMACAttempts bounds the rehashing done to get around collisions
+const maxMACAttempts = 64
+
+// parses the macs in list vms --long output, lines like the following
+//  NIC 1:           MAC: 080027C5B8D8, Attachment: NAT, Cable connected: on
+var reMACInVMList = regexp.MustCompile(`MAC: ([0-9A-Fa-f]{12})`)
+
+// MACAllocationConfig enables deterministic macs for nics that do not set one
+type MACAllocationConfig struct {
+	// OUI is the 3 byte vendor prefix of allocated macs, defaults to DefaultOUI
+	OUI string
+}
+
+// allocateMACs sets a mac on every nic of vm without one, derived from the vm name and nic index so
+// redefining the vm yields the same macs. Macs in use by other vms are avoided
+func (vb *VBox) allocateMACs(vm *VirtualMachine) error {
+	oui, err := vb.Config.MACAllocation.oui()
+	if err != nil {
+		return err
+	}
+
+	var used map[string]bool
+	nics := vm.Spec.NICs
+	for i := range nics {
+		if nics[i].MAC != "" {
+			continue
+		}
+
+		if used == nil {
+			if used, err = vb.usedMACs(vm); err != nil {
+				return err
+			}
+		}
+
+		mac, err := deriveMAC(oui, vm.Spec.Name, nics[i].Index, used)
+		if err != nil {
+			return ValidationError{Path: fmt.Sprintf("nic/%d", i), Err: err}
+		}
+		used[normalizeMAC(mac)] = true
+		nics[i].MAC = mac
+	}
+	return nil
+}
+
+// deriveMAC hashes the vm name and nic index into the lower 3 bytes of the mac, rehashing with an attempt
+// counter while the result is in used. The mac is returned as showvminfo prints it, e.g 080027C5B8D8
+func deriveMAC(oui net.HardwareAddr, vmName string, index int, used map[string]bool) (string, error) {
+	for attempt := 0; attempt < maxMACAttempts; attempt++ {
+		seed := fmt.Sprintf("%s/%d", vmName, index)
+		if attempt > 0 {
+			seed = fmt.Sprintf("%s/%d", seed, attempt)
+		}
+		sum := sha1.Sum([]byte(seed))
+
+		mac := normalizeMAC(append(append(net.HardwareAddr{}, oui...), sum[0], sum[1], sum[2]).String())
+		if !used[mac] {
+			return strings.ToUpper(mac), nil
+		}
+	}
+	return "", fmt.Errorf("no free mac found for nic %d of %s", index, vmName)
+}
+
+// usedMACs returns the normalized macs of all registered vms other than vm
+func (vb *VBox) usedMACs(vm *VirtualMachine) (map[string]bool, error) {
+	out, err := vb.manage("list", "vms", "--long")
+	if err != nil {
+		return nil, err
+	}
+
+	used := map[string]bool{}
+	for _, match := range reMACInVMList.FindAllStringSubmatch(out, -1) {
+		used[normalizeMAC(match[1])] = true
+	}
+
+	// the vm may be getting redefined, its own macs are not collisions
+	if self, err := vb.VMInfo(vm.UUIDOrName()); err == nil {
+		for _, nic := range self.Spec.NICs {
+			delete(used, normalizeMAC(nic.MAC))
+		}
+	}
+
+	return used, nil
+}
+
+func (c *MACAllocationConfig) oui() (net.HardwareAddr, error) {
+	oui := DefaultOUI
+	if c.OUI != "" {
+		oui = c.OUI
+	}
+
+	b, err := net.ParseMAC(oui + ":00:00:00")
+	if err != nil || len(b) != 6 {
+		return nil, fmt.Errorf("invalid oui %s", oui)
+	}
+	if b[0]&1 == 1 {
+		return nil, fmt.Errorf("oui %s is a multicast prefix", oui)
+	}
+	return b[:3], nil
+}
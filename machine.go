@@ -2,10 +2,13 @@ package virtualbox
 
 import (
 	"context"
+	"encoding/xml"
 	"fmt"
 	"github.com/golang/glog"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"regexp"
 	"strconv"
 	"strings"
 )
@@ -32,8 +35,16 @@ func (vb *VBox) CreateVM(vm *VirtualMachine) error {
 }
 
 // DeleteVM removes the setting file and must be  used with caution.  The VM must be unregistered before calling this
+// Addresses allocated to the vm by IPAM are released
 func (vb *VBox) DeleteVM(vm *VirtualMachine) error {
-	return os.RemoveAll(vb.getVMSettingsFile(vm))
+	if err := os.RemoveAll(vb.getVMSettingsFile(vm)); err != nil {
+		return err
+	}
+
+	if vb.Config.IPAM != nil {
+		return vb.ReleaseIPs(vm)
+	}
+	return nil
 }
 
 // TODO: Ensure this is idempotent
@@ -48,39 +59,151 @@ func (vb *VBox) UnRegisterVM(vm *VirtualMachine) error {
 }
 
 func (vb *VBox) AddStorageController(vm *VirtualMachine, ctr StorageController) error {
-
-	_, err := vb.manage("storagectl", vm.UUIDOrName(), "--name", ctr.Name, "--add", string(ctr.Type))
+	args := append([]string{"--add", ctr.Type.ForStorageCtl()}, storageControllerArgs(ctr)...)
+	_, err := vb.storageCtl(vm, ctr.Name, args...)
 	if err != nil && isAlreadyExistErrorMessage(err.Error()) {
-		return AlreadyExists(vm.Spec.Name)
+		return AlreadyExistsErrorr.New(ctr.Name, "use ModifyStorageController")
 	}
-	return nil
+	return err
 }
 
-func (vb *VBox) AttachStorage(vm *VirtualMachine, disk *Disk) error {
-	nonRotational := "off"
-	if disk.NonRotational {
-		nonRotational = "on"
-	}
-	autoDiscard := "off"
-	if disk.AutoDiscard {
-		if disk.Format != VDI {
-			glog.Warning(
-				"Disk format ", disk.Format, " is not VDI. ",
-				"Ignoring AutoDiscard.")
-		} else {
-			autoDiscard = "on"
+// ModifyStorageController applies the chipset, port count, host io cache and bootable settings of ctr to the
+// existing controller of the same name. The bus type of a controller cannot be changed
+func (vb *VBox) ModifyStorageController(vm *VirtualMachine, ctr StorageController) error {
+	_, err := vb.storageCtl(vm, ctr.Name, storageControllerArgs(ctr)...)
+	return err
+}
+
+func (vb *VBox) RenameStorageController(vm *VirtualMachine, name, newName string) error {
+	_, err := vb.storageCtl(vm, name, "--rename", newName)
+	return err
+}
+
+// RemoveStorageController removes a controller along with the attachments of its disks, the disks are kept
+func (vb *VBox) RemoveStorageController(vm *VirtualMachine, name string) error {
+	_, err := vb.storageCtl(vm, name, "--remove")
+	return err
+}
+
+func (vb *VBox) storageCtl(vm *VirtualMachine, name string, args ...string) (string, error) {
+	return vb.manage(append([]string{"storagectl", vm.UUIDOrName(), "--name", name}, args...)...)
+}
+
+func storageControllerArgs(ctr StorageController) []string {
+	var args []string
+	if ctr.HostIOCache != nil {
+		hostIOCache := "off"
+		if *ctr.HostIOCache {
+			hostIOCache = "on"
 		}
+		args = append(args, "--hostiocache", hostIOCache)
 	}
-	_, err := vb.manage(
+	if ctr.Chipset != "" {
+		args = append(args, "--controller", string(ctr.Chipset))
+	}
+	if ctr.PortCount > 0 {
+		args = append(args, "--portcount", strconv.Itoa(ctr.PortCount))
+	}
+	if ctr.Bootable != "" {
+		args = append(args, "--bootable", ctr.Bootable)
+	}
+	return args
+}
+
+func (vb *VBox) AttachStorage(vm *VirtualMachine, disk *Disk) error {
+	args := []string{
 		"storageattach", vm.Spec.Name,
 		"--storagectl", disk.Controller.Name,
 		"--port", strconv.Itoa(disk.Controller.Port),
 		"--device", strconv.Itoa(disk.Controller.Device),
 		"--type", string(disk.Type),
-		"--medium", disk.Path,
-		"--nonrotational", nonRotational,
-		"--discard", autoDiscard)
+		"--medium", disk.medium(),
+	}
+
+	switch disk.Type {
+	case DVDDrive:
+		if disk.HostDrive != "" && disk.Passthrough {
+			args = append(args, "--passthrough", "on")
+		}
+	case HDDrive:
+		nonRotational := "off"
+		if disk.NonRotational {
+			nonRotational = "on"
+		}
+		autoDiscard := "off"
+		if disk.AutoDiscard {
+			if disk.Format != VDI {
+				glog.Warning(
+					"Disk format ", disk.Format, " is not VDI. ",
+					"Ignoring AutoDiscard.")
+			} else {
+				autoDiscard = "on"
+			}
+		}
+		args = append(args, "--nonrotational", nonRotational, "--discard", autoDiscard)
+	}
 
+	if disk.HotPluggable {
+		if disk.Controller.Type != SATA {
+			return ValidationError{Path: "hotpluggable", Err: fmt.Errorf("%s ports cannot be hot pluggable", disk.Controller.Type)}
+		}
+		// running vms keep the mark their ports got while powered off
+		if running, err := vb.isRunning(vm); err != nil {
+			return err
+		} else if !running {
+			args = append(args, "--hotpluggable", "on")
+		}
+	}
+
+	_, err := vb.manage(args...)
+	return err
+}
+
+// DetachStorage removes the medium attached to the port and device of attachment. Running vms can only have
+// media detached from hot pluggable ports
+func (vb *VBox) DetachStorage(vm *VirtualMachine, attachment StorageControllerAttachment) error {
+	_, err := vb.manage(
+		"storageattach", vm.UUIDOrName(),
+		"--storagectl", attachment.Name,
+		"--port", strconv.Itoa(attachment.Port),
+		"--device", strconv.Itoa(attachment.Device),
+		"--medium", "none")
+	return err
+}
+
+// InsertMedium puts the iso image at path into drive, a dvd drive attached to vm. A medium locked by the
+// guest of a running vm is unmounted forcibly
+func (vb *VBox) InsertMedium(vm *VirtualMachine, drive *Disk, path string) error {
+	if err := vb.changeMedium(vm, drive, path); err != nil {
+		return err
+	}
+	drive.Path, drive.HostDrive, drive.UUID = path, "", ""
+	return nil
+}
+
+// EjectMedium empties drive, a dvd drive attached to vm. A medium locked by the guest of a running vm is
+// unmounted forcibly
+func (vb *VBox) EjectMedium(vm *VirtualMachine, drive *Disk) error {
+	if err := vb.changeMedium(vm, drive, "emptydrive"); err != nil {
+		return err
+	}
+	drive.Path, drive.HostDrive, drive.UUID = "", "", ""
+	return nil
+}
+
+func (vb *VBox) changeMedium(vm *VirtualMachine, drive *Disk, medium string) error {
+	if drive.Type != DVDDrive {
+		return fmt.Errorf("media can only be changed on %s, got %s", DVDDrive, drive.Type)
+	}
+
+	_, err := vb.manage(
+		"storageattach", vm.UUIDOrName(),
+		"--storagectl", drive.Controller.Name,
+		"--port", strconv.Itoa(drive.Controller.Port),
+		"--device", strconv.Itoa(drive.Controller.Device),
+		"--type", string(DVDDrive),
+		"--medium", medium,
+		"--forceunmount")
 	return err
 }
 
@@ -103,8 +226,23 @@ func (vb *VBox) SetBootOrder(vm *VirtualMachine, bootOrder []BootDevice) error {
 	return err
 }
 
+// Start boots vm headless and hands it the passwords of the encrypted disks in its spec
 func (vb *VBox) Start(vm *VirtualMachine) (string, error) {
-	return vb.manage("startvm", vm.UUIDOrName(), "--type", "headless")
+	out, err := vb.manage("startvm", vm.UUIDOrName(), "--type", "headless")
+	if err != nil {
+		return out, err
+	}
+
+	for _, p := range encryptionPasswords(vm) {
+		if err := vb.AddEncryptionPassword(vm, p.PasswordID, p.PasswordFile, false); err != nil {
+			// the vm cannot use its encrypted disks without the password, do not leave it running
+			if _, stopErr := vb.Stop(vm); stopErr != nil {
+				err = fmt.Errorf("%v, the vm is still running as powering it off failed: %v", err, stopErr)
+			}
+			return out, OperationError{Path: "encryption/" + p.PasswordID, Op: "addencpassword", Err: err}
+		}
+	}
+	return out, nil
 }
 
 func (vb *VBox) Stop(vm *VirtualMachine) (string, error) {
@@ -132,11 +270,63 @@ func (vb *VBox) Reset(vm *VirtualMachine) (string, error) {
 	return vb.control(vm, "reset")
 }
 
+// VMState returns the state of vm as reported by showvminfo, e.g running, paused, poweroff
+func (vb *VBox) VMState(vm *VirtualMachine) (string, error) {
+	out, err := vb.manage("showvminfo", vm.UUIDOrName(), "--machinereadable")
+	if err != nil {
+		return "", err
+	}
+
+	var state string
+	_ = parseKeyValues(out, reKeyEqVal, func(key, val string) error {
+		if key == "VMState" {
+			state, _ = strconv.Unquote(val)
+		}
+		return nil
+	})
+	return state, nil
+}
+
+// isRunning is true for vms with a session that must be changed through controlvm rather than modifyvm
+func (vb *VBox) isRunning(vm *VirtualMachine) (bool, error) {
+	state, err := vb.VMState(vm)
+	if err != nil {
+		return false, err
+	}
+	return state == "running" || state == "paused", nil
+}
+
 func (vb *VBox) EnableIOAPIC(vm *VirtualMachine) (string, error) {
 	return vb.modify(vm, "--ioapic", "on")
 }
+
+// parses lines of list vms like the following
+//  "vm01" {6aa44e71-71c6-4e68-a61f-f69e133ecffa}
+var reVMListLine = regexp.MustCompile(`^"(.*)" \{([^}]+)\}$`)
+
+// ListVMs returns the registered vms, only their name and uuid are filled in. Use VMInfo for the rest
+func (vb *VBox) ListVMs() ([]VirtualMachine, error) {
+	out, err := vb.manage("list", "vms")
+	if err != nil {
+		return nil, err
+	}
+
+	var vms []VirtualMachine
+	for _, line := range strings.Split(out, "\n") {
+		if res := reVMListLine.FindStringSubmatch(strings.TrimSpace(line)); res != nil {
+			vm := VirtualMachine{UUID: res[2]}
+			vm.Spec.Name = res[1]
+			vms = append(vms, vm)
+		}
+	}
+	return vms, nil
+}
+
 func (vb *VBox) VMInfo(uuidOrVmName string) (machine *VirtualMachine, err error) {
 	out, err := vb.manage("showvminfo", uuidOrVmName, "--machinereadable")
+	if err != nil {
+		return nil, err
+	}
 
 	// lets populate the map from output strings
 	m := map[string]interface{}{}
@@ -152,8 +342,8 @@ func (vb *VBox) VMInfo(uuidOrVmName string) (machine *VirtualMachine, err error)
 			}
 		} else if i, err := strconv.Atoi(val); err == nil {
 			m[key] = i
-		} else { // we dont expect any actually
-			glog.V(6).Infof("ignoring parsing val %s for key %s", val, key)
+		} else { // unquoted values like BandwidthGroup0=Limit,Network,20M
+			m[key] = val
 		}
 		return nil
 	})
@@ -176,123 +366,31 @@ func (vb *VBox) VMInfo(uuidOrVmName string) (machine *VirtualMachine, err error)
 	vm.Spec.CPU.Count = m["cpus"].(int)
 	vm.Spec.Memory.SizeMB = m["memory"].(int)
 
-	// fill in storage details
-	vm.Spec.StorageControllers = make([]StorageController, 0, 2)
-
-	for i := 0; i < 20; i++ { // upto a 20 storage controller? :)
-		sk := fmt.Sprintf("storagecontrollername%d", i)
-		if v, ok := m[sk]; ok { //  e.g of v is SATA1
-
-			sc := StorageController{Name: v.(string)}
-
-			switch fmt.Sprintf("storagecontrollertype%d", i) {
-			case string(SATA):
-				sc.Type = SATA
-			case string(IDE):
-				sc.Type = IDE
-			case string(SCSCI):
-				sc.Type = SCSCI
-			case string(NVME):
-				sc.Type = NVME
-			}
-
-			var err error
-
-			if si, ok := m[fmt.Sprintf("storagecontrollerinstance%d", i)]; ok {
-				if sc.Instance, err = strconv.Atoi(si.(string)); err != nil {
-					return nil, fmt.Errorf("wrong val")
-				}
-			}
-
-			if sb, ok := m[fmt.Sprintf("storagecontrollerbootable%d", i)]; ok {
-				if sc.Bootable, ok = sb.(string); !ok {
-					return nil, fmt.Errorf("wrong val for storagecontrollerbootable")
-				}
-			}
-
-			if sp, ok := m[fmt.Sprintf("storagecontrollerportcount%d", i)]; ok {
-				if sc.PortCount, err = strconv.Atoi(sp.(string)); err != nil {
-					return nil, fmt.Errorf("wrong val for storageportcount")
-				}
-			}
-
-			vm.Spec.Disks = make([]Disk, 0, 2)
-
-			for j := 0; j < sc.PortCount; j++ {
-				dp := fmt.Sprintf("%s-%d-%d", v, j, 0) // key to path of disk, e.g SATA1-0-0
-				if dpv, ok := m[dp]; ok && dpv != "none" {
-					d := Disk{
-						Path: dpv.(string),
-						Controller: StorageControllerAttachment{
-							Type: sc.Type,
-							Port: j,
-							Name: sc.Name,
-						},
-					}
-					if duv, ok := m[fmt.Sprintf("%s-ImageUUID-%d-%d", v, j, 0)]; ok { // e.g SATA1-ImageUUID-0-0
-						d.UUID = duv.(string)
-					}
-					vm.Spec.Disks = append(vm.Spec.Disks, d)
-				}
-			}
-			vm.Spec.StorageControllers = append(vm.Spec.StorageControllers, sc)
-
-		} else { //storage controllers index not found, dont loop anymore
-			break
-		}
+	// the settings file fills in what showvminfo does not print
+	settings, err := readVMSettings(path)
+	if err != nil {
+		glog.Warningf("cannot read settings file %s, nic and disk details will be incomplete: %v", path, err)
+		settings = &vmSettingsXML{}
 	}
 
-	// now populate network
-
-	for i := 1; i < 20; i++ { // upto a 20 nics
-		n := fmt.Sprintf("nic%d", i)
-
-		nic := NIC{}
-		if v, ok := m[n]; ok {
-			if v == "none" {
-				continue
-			}
-			nic.Mode = NetworkMode(v.(string))
-		} else {
-			continue
-		}
-
-		n = fmt.Sprintf("nictype%d", i)
-		if v, ok := m[n]; ok {
-			nic.Type = NICType(v.(string))
-		}
-
-		n = fmt.Sprintf("nicspeed%d", i)
-		if v, ok := m[n]; ok {
-			nic.Speedkbps, err = strconv.Atoi(v.(string))
-		}
-
-		n = fmt.Sprintf("macaddress%d", i)
-		if v, ok := m[n]; ok {
-			nic.MAC = v.(string)
-		}
+	if vm.Spec.StorageControllers, vm.Spec.Disks, err = parseStorage(m, settings); err != nil {
+		return nil, err
+	}
 
-		n = fmt.Sprintf("cableconnected%d", i)
-		if v, ok := m[n]; ok {
-			nic.CableConnected = v.(string) == "on"
+	for i := 0; ; i++ {
+		v, ok := m[fmt.Sprintf("BandwidthGroup%d", i)]
+		if !ok {
+			break
 		}
-
-		switch nic.Mode {
-		case NWMode_hostonly:
-			n = fmt.Sprintf("hostonlyadapter%d", i)
-			if v, ok := m[n]; ok {
-				nic.NetworkName = v.(string)
-			}
-		case NWMode_natnetwork:
-			n = fmt.Sprintf("natnet%d", i)
-			if v, ok := m[n]; ok {
-				nic.NetworkName = v.(string)
-			}
+		group, err := parseBandwidthGroup(v.(string))
+		if err != nil {
+			return nil, err
 		}
-
-		vm.Spec.NICs = append(vm.Spec.NICs, nic)
+		vm.Spec.BandwidthGroups = append(vm.Spec.BandwidthGroups, group)
 	}
 
+	vm.Spec.NICs = parseNICs(m, settings)
+
 	return vm, nil
 }
 
@@ -332,8 +430,16 @@ func (vb *VBox) Define(context context.Context, vm *VirtualMachine) (*VirtualMac
 	}
 
 	for i, ctr := range vm.Spec.StorageControllers {
-		if err := vb.AddStorageController(vm, ctr); err != nil && !IsAlreadyExistsError(err) {
-			return nil, OperationError{Path: fmt.Sprintf("storagecontroller/%d", i), Op: "add", Err: err}
+		err := vb.AddStorageController(vm, ctr)
+		if IsAlreadyExistsError(err) {
+			err = nil
+			// controllers left to the virtualbox defaults have nothing to modify
+			if len(storageControllerArgs(ctr)) > 0 {
+				err = vb.ModifyStorageController(vm, ctr)
+			}
+		}
+		if err != nil {
+			return nil, OperationError{Path: fmt.Sprintf("storagecontroller/%d", i), Op: "ensure", Err: err}
 		}
 	}
 
@@ -348,6 +454,16 @@ func (vb *VBox) Define(context context.Context, vm *VirtualMachine) (*VirtualMac
 		return nil, OperationError{Path: "ioapic", Op: "enable", Err: err}
 	}
 
+	for i, group := range vm.Spec.BandwidthGroups {
+		err := vb.AddBandwidthGroup(vm, group)
+		if IsAlreadyExistsError(err) {
+			err = vb.SetBandwidthLimit(vm, group.Name, group.Limit)
+		}
+		if err != nil {
+			return nil, OperationError{Path: fmt.Sprintf("bandwidthgroup/%d", i), Op: "ensure", Err: err}
+		}
+	}
+
 	var nics = vm.Spec.NICs
 	for i := range nics {
 		if err := vb.AddNic(vm, &nics[i]); err != nil {
@@ -355,6 +471,12 @@ func (vb *VBox) Define(context context.Context, vm *VirtualMachine) (*VirtualMac
 		}
 	}
 
+	if vb.Config.IPAM != nil {
+		if _, err := vb.AssignIPs(vm); err != nil {
+			return nil, err
+		}
+	}
+
 	if len(vm.Spec.Boot) > 0 {
 		vb.SetBootOrder(vm, vm.Spec.Boot)
 	}
@@ -368,6 +490,13 @@ func (vb *VBox) Define(context context.Context, vm *VirtualMachine) (*VirtualMac
 		vm.UUID = dvm.UUID
 	}
 
+	// macs left to virtualbox are copied back so the spec matches what was defined
+	for i := range vm.Spec.NICs {
+		if nic := dvm.nic(vm.Spec.NICs[i].Index); nic != nil && vm.Spec.NICs[i].MAC == "" {
+			vm.Spec.NICs[i].MAC = nic.MAC
+		}
+	}
+
 	return dvm, nil
 }
 
@@ -381,14 +510,16 @@ func (vb *VBox) EnsureVMHostPath(vm *VirtualMachine) error {
 func (vb *VBox) EnsureDefaults(vm *VirtualMachine) (machine *VirtualMachine, err error) {
 
 	verr := ValidationErrors{}
-	tsctl := map[string]*StorageController{}
+	ctrs := []StorageController{}
+	tsctl := map[string]bool{}
 
 	for i, c := range vm.Spec.StorageControllers {
 		if c.Name == "" {
 			c.Name = fmt.Sprintf("%s%d", string(c.Type), i+1) // for e.g ide1
 		}
-		if _, ok := tsctl[c.Name]; !ok {
-			tsctl[c.Name] = &c
+		if !tsctl[c.Name] {
+			tsctl[c.Name] = true
+			ctrs = append(ctrs, c)
 		} else {
 			verr.Add(fmt.Sprintf("storagecontroller/[%d]/", i), fmt.Errorf("duplicate name"))
 		}
@@ -400,14 +531,47 @@ func (vb *VBox) EnsureDefaults(vm *VirtualMachine) (machine *VirtualMachine, err
 	for i := range disks {
 		disk := &vm.Spec.Disks[i]
 
-		if !filepath.IsAbs(disks[i].Path) {
-			disks[i].Path = fmt.Sprintf("%s/%s", vb.getVMBaseDir(vm), disks[i].Path)
+		if parent := disk.Parent; parent != nil {
+			// bases are shared between vms and live outside of the vm folders
+			if parent.Path != "" && !filepath.IsAbs(parent.Path) {
+				parent.Path = filepath.Join(vb.Config.BasePath, parent.Path)
+			}
+			if parent.UUID == "" && parent.Path == "" {
+				verr.Add(fmt.Sprintf("disk/%d/parent", i), fmt.Errorf("parent needs a uuid or an absolute file path"))
+			}
+			if parent.Type == "" {
+				parent.Type = HDDrive
+			}
+			// children are named after their base by default, e.g ubuntu.vdi for a base at /images/ubuntu.vmdk
+			if disk.Path == "" && parent.Path != "" {
+				base := filepath.Base(parent.Path)
+				disk.Path = strings.TrimSuffix(base, filepath.Ext(base)) + ".vdi"
+			}
 		}
 
 		if disks[i].Type == "" {
 			disks[i].Type = HDDrive
 		}
 
+		// raw devices are mapped by a VMDK named after the device by default, e.g sdb.vmdk
+		if disk.RawDevice != "" {
+			if disk.Path == "" {
+				disk.Path = filepath.Base(disk.RawDevice) + ".vmdk"
+			}
+			if disk.Format == "" {
+				disk.Format = VMDK
+			} else if disk.Format != VMDK {
+				verr.Add(fmt.Sprintf("disk/%d/format", i), fmt.Errorf("raw devices are mapped by VMDK disks, got %s", disk.Format))
+			}
+		}
+
+		// empty and host dvd drives have no image
+		emptyDrive := disks[i].Type == DVDDrive && (disks[i].Path == "" || disks[i].HostDrive != "")
+
+		if !emptyDrive && !filepath.IsAbs(disks[i].Path) {
+			disks[i].Path = fmt.Sprintf("%s/%s", vb.getVMBaseDir(vm), disks[i].Path)
+		}
+
 		if disk.Controller.Type == "" {
 			disk.Controller.Type = SATA
 		}
@@ -416,50 +580,27 @@ func (vb *VBox) EnsureDefaults(vm *VirtualMachine) (machine *VirtualMachine, err
 			sctlName := fmt.Sprintf("%s1", string(disk.Controller.Type))
 			disk.Controller.Name = sctlName // default to 1, for e.g ide1
 			// auto create a storage controller if one does not already exist
-			if _, ok := tsctl[sctlName]; !ok {
-				tsctl[sctlName] = &StorageController{Name: sctlName, Type: disk.Controller.Type}
+			if !tsctl[sctlName] {
+				tsctl[sctlName] = true
+				ctrs = append(ctrs, StorageController{Name: sctlName, Type: disk.Controller.Type})
 			}
 		}
 
-		if disks[i].Format == "" {
+		if disks[i].Format == "" && disks[i].Type == HDDrive {
 			disks[i].Format = VDI
 		}
 	}
 
-	// counts track the number of disks using a storage controller
-	counts := map[string]int{}
-
-	// now set back the storage controllers to VM
-	vm.Spec.StorageControllers = []StorageController{}
-	for k, v := range tsctl {
-		vm.Spec.StorageControllers = append(vm.Spec.StorageControllers, *v)
-		counts[k] = 0
-	}
-
-	// now ensure that we account for all user set and auto assigned (defaulted) value and attach them to ports
 	for i := range disks {
-
-		if disks[i].Path == "" {
+		if disks[i].Path == "" && disks[i].Type != DVDDrive {
 			verr.Add(fmt.Sprintf("disk/%d", i), fmt.Errorf("disk path is empty, needs an absolute file path"))
 		}
-
-		if count, ok := counts[disks[i].Controller.Name]; ok {
-			counts[disks[i].Controller.Name] = count + 1
-			switch disks[i].Controller.Type {
-			case IDE:
-				disks[i].Controller.Port = count / 2
-				disks[i].Controller.Device = count % 2
-			case SATA:
-				disks[i].Controller.Port = count
-			default:
-				disks[i].Controller.Port = count
-				glog.Warning("trying to default the port for controller type %s, this might not work", disks[i].Controller.Type)
-			}
-
-		} else {
-			verr.Add(fmt.Sprintf("disk/%d", i), fmt.Errorf("storagecontroller ref %s did not resolve", disks[i].Controller.Name))
-		}
 	}
+	validateEncryption(disks, &verr)
+
+	// now account for all user pinned and auto assigned ports and set back the storage controllers to VM
+	allocatePorts(ctrs, disks, &verr)
+	vm.Spec.StorageControllers = ctrs
 
 	if err := vb.SetNICDefaults(vm); err != nil {
 		return nil, err
@@ -475,3 +616,47 @@ func (vb *VBox) EnsureDefaults(vm *VirtualMachine) (machine *VirtualMachine, err
 func isAlreadyExistErrorMessage(out string) bool {
 	return strings.Contains(out, "already exists")
 }
+
+// vmSettingsXML maps the parts of the .vbox settings file that showvminfo does not print
+type vmSettingsXML struct {
+	Adapters           []adapterSettingsXML           `xml:"Machine>Hardware>Network>Adapter"`
+	StorageControllers []storageControllerSettingsXML `xml:"Machine>StorageControllers>StorageController"`
+}
+
+type adapterSettingsXML struct {
+	Slot                  int    `xml:"slot,attr"`
+	BandwidthGroup        string `xml:"bandwidthGroup,attr"`
+	BootPriority          int    `xml:"bootPriority,attr"`
+	PromiscuousModePolicy string `xml:"promiscuousModePolicy,attr"`
+	GenericInterface      struct {
+		Driver     string                `xml:"driver,attr"`
+		Properties []propertySettingsXML `xml:"Property"`
+	} `xml:"GenericInterface"`
+}
+
+type propertySettingsXML struct {
+	Name  string `xml:"name,attr"`
+	Value string `xml:"value,attr"`
+}
+
+func (s *vmSettingsXML) adapter(index int) *adapterSettingsXML {
+	for i := range s.Adapters {
+		if s.Adapters[i].Slot == index-1 { // slots are 0 based
+			return &s.Adapters[i]
+		}
+	}
+	return nil
+}
+
+func readVMSettings(path string) (*vmSettingsXML, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var settings vmSettingsXML
+	if err := xml.Unmarshal(data, &settings); err != nil {
+		return nil, err
+	}
+	return &settings, nil
+}
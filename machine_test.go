@@ -8,6 +8,7 @@ import (
 	"os"
 	"path/filepath"
 	"sort"
+	"strings"
 	"testing"
 	"time"
 
@@ -398,3 +399,70 @@ vcprate=512
 vcpfps=25
 GuestMemoryBalloon=0
 `
+
+func TestVBox_HotPlugDisk(t *testing.T) {
+	// Object under test
+	vb := NewVBox(Config{})
+
+	vm := &VirtualMachine{}
+	vm.Spec.Name = "testvm-hotplug"
+	vm.Spec.Group = "/tess"
+	vm.Spec.OSType = Linux64
+	vm.Spec.CPU.Count = 1
+	vm.Spec.Memory.SizeMB = 256
+	vm.Spec.Disks = []Disk{
+		{Path: "disk1.vdi", SizeMB: 10},
+		{Path: "volume1.vdi", SizeMB: 10, HotPluggable: true},
+	}
+
+	vb.EnsureDefaults(vm)
+
+	vb.UnRegisterVM(vm)
+	vb.DeleteVM(vm)
+
+	defer vb.DeleteVM(vm)
+	defer vb.UnRegisterVM(vm)
+
+	if _, err := vb.Define(context.Background(), vm); err != nil {
+		t.Fatalf("Error defining %#v", err)
+	}
+
+	if _, err := vb.Start(vm); err != nil {
+		t.Fatalf("Failed to start vm %s, error %v", vm.Spec.Name, err)
+	}
+	defer vb.Stop(vm)
+
+	volume := &vm.Spec.Disks[1]
+	if err := vb.DetachStorage(vm, volume.Controller); err != nil {
+		t.Fatalf("Failed to detach volume from running vm %v", err)
+	}
+	if err := vb.AttachStorage(vm, volume); err != nil {
+		t.Errorf("Failed to attach volume to running vm %v", err)
+	}
+}
+
+func TestStorageControllerArgs(t *testing.T) {
+	ctr := StorageController{Name: "SCSCI1", Type: SCSCI, Chipset: Chipset_BusLogic, PortCount: 8, Bootable: "off", HostIOCache: BoolPtr(true)}
+
+	expected := "--hostiocache on --controller BusLogic --portcount 8 --bootable off"
+	if args := strings.Join(storageControllerArgs(ctr), " "); args != expected {
+		t.Errorf("expected %s, got %s", expected, args)
+	}
+
+	// the host io cache is left to virtualbox unless set
+	ctr.HostIOCache = nil
+	if args := strings.Join(storageControllerArgs(ctr), " "); args != "--controller BusLogic --portcount 8 --bootable off" {
+		t.Errorf("expected no hostiocache flag, got %s", args)
+	}
+
+	// default controllers have no settings, see Define
+	if args := storageControllerArgs(StorageController{Name: "SATA1", Type: SATA}); len(args) != 0 {
+		t.Errorf("expected no args for a default controller, got %v", args)
+	}
+
+	for typ, bus := range map[StorageControllerType]string{SCSCI: "scsi", NVME: "pcie", VirtIO: "virtio", SATA: "sata"} {
+		if typ.ForStorageCtl() != bus {
+			t.Errorf("expected bus %s for %s, got %s", bus, typ, typ.ForStorageCtl())
+		}
+	}
+}
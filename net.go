@@ -1,9 +1,13 @@
 package virtualbox
 
 import (
+	"bytes"
+	"context"
 	"fmt"
+	"net"
 	"regexp"
 	"sort"
+	"strconv"
 	"strings"
 )
 
@@ -26,6 +30,12 @@ func (vb *VBox) HostOnlyNetInfo() ([]Network, error) {
 			nw.HWAddress = val
 		case "VBoxNetworkName":
 			nw.DeviceName = val[len("HostInterfaceNetworking-"):]
+		case "IPAddress":
+			nw.IPNet.IP = net.ParseIP(val)
+		case "NetworkMask":
+			if mask := net.ParseIP(val).To4(); mask != nil {
+				nw.IPNet.Mask = net.IPMask(mask)
+			}
 		default:
 			if !ok && strings.TrimSpace(val) == "" {
 				nw.Mode = NWMode_hostonly
@@ -38,6 +48,47 @@ func (vb *VBox) HostOnlyNetInfo() ([]Network, error) {
 	return nws, nil
 }
 
+// HostOnlyNetworkInfo lists the hostonlynets, available with VirtualBox 7 and later on macOS
+func (vb *VBox) HostOnlyNetworkInfo() ([]Network, error) {
+	out, err := vb.manage("list", "hostonlynets")
+	if err != nil {
+		return nil, err
+	}
+
+	var nws []Network
+
+	var nw Network
+	_ = tryParseKeyValues(out, reColonLine, func(key, val string, ok bool) error {
+		switch key {
+		case "Name":
+			nw.Name = val
+		case "GUID":
+			nw.GUID = val
+		case "NetworkMask":
+			if mask := net.ParseIP(val).To4(); mask != nil {
+				nw.IPNet.Mask = net.IPMask(mask)
+			}
+		case "LowerIP":
+			nw.LowerIP = net.ParseIP(val)
+		case "UpperIP":
+			nw.UpperIP = net.ParseIP(val)
+		case "VBoxNetworkName":
+			nw.DeviceName = val
+		default:
+			if !ok && strings.TrimSpace(val) == "" {
+				if nw.LowerIP != nil && nw.IPNet.Mask != nil {
+					nw.IPNet.IP = nw.LowerIP.Mask(nw.IPNet.Mask)
+				}
+				nw.Mode = NWMode_hostonlynet
+				nws = append(nws, nw)
+				nw = Network{}
+			}
+		}
+		return nil
+	})
+	return nws, nil
+}
+
 func (vb *VBox) NatNetInfo() ([]Network, error) {
 	out, err := vb.manage("list", "natnets")
 	if err != nil {
@@ -51,6 +102,10 @@ func (vb *VBox) NatNetInfo() ([]Network, error) {
 		switch key {
 		case "NetworkName":
 			nw.Name = val
+		case "Network":
+			if _, ipnet, err := net.ParseCIDR(val); err == nil {
+				nw.IPNet = *ipnet
+			}
 		default:
 			if !ok && strings.TrimSpace(val) == "" {
 				nw.Mode = NWMode_natnetwork
@@ -119,45 +174,42 @@ func (vb *VBox) BridgeNetInfo() ([]Network, error) {
 	return nws, nil
 }
 
+// SyncNICs lists the host networks into vb.Networks, bypassing the registry cache
 func (vb *VBox) SyncNICs() (err error) {
+	_, err = vb.networks().ForceRefresh(context.Background())
+	return err
+}
 
-	if hostOnlyNws, err := vb.HostOnlyNetInfo(); err != nil {
-		return err
-	} else {
-		for i := range hostOnlyNws {
-			vb.HostOnlyNws[hostOnlyNws[i].Name] = &hostOnlyNws[i]
-		}
+// listNetworks lists the networks of every mode, it populates vb.Networks
+func (vb *VBox) listNetworks() ([]Network, error) {
+	listers := []func() ([]Network, error){vb.HostOnlyNetInfo, vb.InternalNetInfo, vb.NatNetInfo, vb.BridgeNetInfo}
+	if vb.HostOnlyMode() == NWMode_hostonlynet {
+		listers = append(listers, vb.HostOnlyNetworkInfo)
 	}
 
-	if internalNws, err := vb.InternalNetInfo(); err != nil {
-		return err
-	} else {
-		for i := range internalNws {
-			vb.InternalNws[internalNws[i].Name] = &internalNws[i]
+	var nws []Network
+	for _, list := range listers {
+		listed, err := list()
+		if err != nil {
+			return nil, err
 		}
+		nws = append(nws, listed...)
 	}
+	return nws, nil
+}
 
-	if natNws, err := vb.NatNetInfo(); err != nil {
-		return err
-	} else {
-		for i := range natNws {
-			vb.NatNws[natNws[i].Name] = &natNws[i]
-		}
+// CreateNet creates a host-only network. Networks without a mode get the host-only model of the installed
+// VirtualBox, see HostOnlyMode. Hostonly interfaces are named by virtualbox and net.Name is updated to match
+func (vb *VBox) CreateNet(net *Network) error {
+	if net.Mode == "" {
+		net.Mode = vb.HostOnlyMode()
 	}
+	defer vb.networks().Invalidate()
 
-	if bridgedNws, err := vb.BridgeNetInfo(); err != nil {
-		return err
-	} else {
-		for i := range bridgedNws {
-			vb.BridgedNws[bridgedNws[i].Name] = &bridgedNws[i]
-		}
+	if net.Mode == NWMode_hostonlynet {
+		return vb.createHostOnlyNetwork(net)
 	}
 
-	return nil
-}
-
-func (vb *VBox) CreateNet(net *Network) error {
-
 	out, err := vb.manage("hostonlyif", "create")
 	if err != nil {
 		return err
@@ -174,49 +226,372 @@ func (vb *VBox) CreateNet(net *Network) error {
 	return err
 }
 
+// createHostOnlyNetwork adds a VirtualBox 7 macOS hostonlynet, the address range defaults to the whole of net.IPNet
+func (vb *VBox) createHostOnlyNetwork(net *Network) error {
+	if net.Name == "" {
+		return fmt.Errorf("hostonlynet needs a name")
+	}
+
+	args := append([]string{"hostonlynet", "add", "--name", net.Name}, hostOnlyNetworkArgs(net)...)
+	_, err := vb.manage(append(args, "--enable")...)
+	return err
+}
+
+func hostOnlyNetworkArgs(nw *Network) []string {
+	if nw.IPNet.IP == nil {
+		return nil
+	}
+
+	lower, upper := nw.LowerIP, nw.UpperIP
+	if lower == nil {
+		lower = ipAdd(nw.IPNet.IP.Mask(nw.IPNet.Mask), 1)
+	}
+	if upper == nil {
+		upper = ipAdd(broadcastIP(nw.IPNet), -1)
+	}
+
+	return []string{"--netmask", net.IP(nw.IPNet.Mask).String(), "--lower-ip", lower.String(), "--upper-ip", upper.String()}
+}
+
+// ipAdd returns ip offset by n addresses
+func ipAdd(ip net.IP, n int64) net.IP {
+	res := make(net.IP, len(ip))
+	copy(res, ip)
+	if v4 := res.To4(); v4 != nil {
+		res = v4
+	}
+
+	carry := n
+	for i := len(res) - 1; i >= 0 && carry != 0; i-- {
+		sum := int64(res[i]) + carry
+		res[i] = byte(sum)
+		carry = sum >> 8
+	}
+	return res
+}
+
+// broadcastIP returns the last address of ipnet
+func broadcastIP(ipnet net.IPNet) net.IP {
+	ip := ipnet.IP.Mask(ipnet.Mask)
+	res := make(net.IP, len(ip))
+	for i := range ip {
+		res[i] = ip[i] | ^ipnet.Mask[i]
+	}
+	return res
+}
+
 func (vb *VBox) DeleteNet(net *Network) error {
+	defer vb.networks().Invalidate()
 
+	var err error
 	switch net.Mode {
 	case NWMode_hostonly:
-		_, err := vb.manage("hostonlyif", "remove", net.Name)
-		if err != nil && isHostDeviceNotFound(err.Error()) {
-			return NotFoundError(err.Error())
-		}
+		_, err = vb.manage("hostonlyif", "remove", net.Name)
+	case NWMode_hostonlynet:
+		_, err = vb.manage("hostonlynet", "remove", "--name", net.Name)
 	case NWMode_natnetwork:
-		_, err := vb.manage("natnetwork", "remove", "--netname", net.Name)
-		if err != nil && isHostDeviceNotFound(err.Error()) {
-			return NotFoundError(err.Error())
-		}
+		_, err = vb.manage("natnetwork", "remove", "--netname", net.Name)
 	} //others are no op
 
-	return nil
+	if err != nil && isHostDeviceNotFound(err.Error()) {
+		return NotFoundError(err.Error())
+	}
+	return err
 }
 
 func isHostDeviceNotFound(text string) bool {
 	return strings.Contains(text, "could not be found")
 }
 
+// nicNetworkKeys maps the modes that attach to a named network to the modifyvm flag setting the name and the
+// showvminfo keys reporting it, older versions report nat networks as natnet<N>
+var nicNetworkKeys = map[NetworkMode]struct {
+	flag string
+	keys []string
+}{
+	NWMode_bridged:     {"--bridgeadapter%d", []string{"bridgeadapter%d"}},
+	NWMode_hostonly:    {"--hostonlyadapter%d", []string{"hostonlyadapter%d"}},
+	NWMode_hostonlynet: {"--host-only-net%d", []string{"hostonly-network%d"}},
+	NWMode_intnet:      {"--intnet%d", []string{"intnet%d"}},
+	NWMode_natnetwork:  {"--nat-network%d", []string{"nat-network%d", "natnet%d"}},
+	NWMode_generic:     {"--nicgenericdrv%d", []string{"generic%d"}},
+}
+
+// nicFields are the per nic showvminfo keys and how they are set on the nic
+var nicFields = []struct {
+	key string
+	set func(nic *NIC, val string)
+}{
+	{"nictype%d", func(nic *NIC, val string) { nic.Type = NICType(val) }},
+	{"nicspeed%d", func(nic *NIC, val string) { nic.Speedkbps, _ = strconv.Atoi(val) }},
+	{"macaddress%d", func(nic *NIC, val string) { nic.MAC = val }},
+	{"cableconnected%d", func(nic *NIC, val string) { nic.CableConnected = val == "on" }},
+}
+
+// promiscuous mode policies as stored in the settings file
+var promiscModePolicies = map[string]string{
+	"Deny":         PromiscMode_deny,
+	"AllowNetwork": PromiscMode_allowvms,
+	"AllowAll":     PromiscMode_allowall,
+}
+
+// parseNICs builds the nics from the showvminfo key values m and the settings file, nics that are not
+// attached (none) are left out
+func parseNICs(m map[string]interface{}, settings *vmSettingsXML) []NIC {
+	var nics []NIC
+
+	for i := 1; ; i++ {
+		v, ok := m[fmt.Sprintf("nic%d", i)]
+		if !ok {
+			break
+		}
+		if v == "none" {
+			continue
+		}
+
+		nic := NIC{Index: i, Mode: NetworkMode(fmt.Sprint(v)), PromiscuousMode: PromiscMode_deny}
+
+		for _, f := range nicFields {
+			if v, ok := m[fmt.Sprintf(f.key, i)]; ok {
+				f.set(&nic, fmt.Sprint(v))
+			}
+		}
+
+		if nk, ok := nicNetworkKeys[nic.Mode]; ok {
+			for _, key := range nk.keys {
+				if v, ok := m[fmt.Sprintf(key, i)]; ok {
+					nic.NetworkName = fmt.Sprint(v)
+					break
+				}
+			}
+		}
+
+		if a := settings.adapter(i); a != nil {
+			nic.BandwidthGroup = a.BandwidthGroup
+			nic.BootPrio = a.BootPriority
+			if mode, ok := promiscModePolicies[a.PromiscuousModePolicy]; ok {
+				nic.PromiscuousMode = mode
+			}
+			if nic.Mode == NWMode_generic {
+				if nic.NetworkName == "" {
+					nic.NetworkName = a.GenericInterface.Driver
+				}
+				for _, p := range a.GenericInterface.Properties {
+					if nic.Properties == nil {
+						nic.Properties = map[string]string{}
+					}
+					nic.Properties[p.Name] = p.Value
+				}
+			}
+		}
+
+		nics = append(nics, nic)
+	}
+
+	return nics
+}
+
 func (vb *VBox) AddNic(vm *VirtualMachine, nic *NIC) error {
-	args := []string{}
-	switch nic.Mode {
-	case NWMode_bridged:
-		args = append(args, fmt.Sprintf("--nic %d", nic.Index), string(NWMode_bridged), fmt.Sprintf("--bridgeadapter%d", nic.Index), nic.NetworkName)
-	case NWMode_hostonly:
-		args = append(args, fmt.Sprintf("--nic%d", nic.Index), string(NWMode_hostonly), fmt.Sprintf("--hostonlyadapter%d", nic.Index), nic.NetworkName)
-	case NWMode_intnet:
-		args = append(args, fmt.Sprintf("--nic%d", nic.Index), string(NWMode_intnet), fmt.Sprintf("--intnet%d", nic.Index), nic.NetworkName)
-	case NWMode_natnetwork:
-		args = append(args, fmt.Sprintf("--nic%d", nic.Index), string(NWMode_natnetwork), fmt.Sprintf("--nat-network%d", nic.NetworkName))
+	args := []string{fmt.Sprintf("--nic%d", nic.Index), string(nic.Mode)}
+	if nk, ok := nicNetworkKeys[nic.Mode]; ok {
+		args = append(args, fmt.Sprintf(nk.flag, nic.Index), nic.NetworkName)
+	}
+
+	if nic.Type != "" {
+		args = append(args, fmt.Sprintf("--nictype%d", nic.Index), string(nic.Type))
+	}
+
+	if nic.MAC != "" {
+		args = append(args, fmt.Sprintf("--macaddress%d", nic.Index), normalizeMAC(nic.MAC))
+	}
+
+	if nic.Speedkbps > 0 {
+		args = append(args, fmt.Sprintf("--nicspeed%d", nic.Index), strconv.Itoa(nic.Speedkbps))
+	}
+
+	if nic.BootPrio > 0 {
+		args = append(args, fmt.Sprintf("--nicbootprio%d", nic.Index), strconv.Itoa(nic.BootPrio))
+	}
+
+	if nic.PromiscuousMode != "" {
+		args = append(args, fmt.Sprintf("--nicpromisc%d", nic.Index), nic.PromiscuousMode)
+	}
+
+	if nic.Mode == NWMode_generic {
+		for _, prop := range sortedProperties(nic.Properties) {
+			args = append(args, fmt.Sprintf("--nicproperty%d", nic.Index), prop)
+		}
 	}
 
-	args = append(args, fmt.Sprintf("--nictype%d", nic.Index), string(nic.Type))
+	if nic.BandwidthGroup != "" {
+		args = append(args, fmt.Sprintf("--nicbandwidthgroup%d", nic.Index), nic.BandwidthGroup)
+	}
 
 	_, err := vb.modify(vm, args...)
 	return err
 }
 
+// SetLinkState plugs (up) or pulls the virtual cable of nic index of a running vm
+func (vb *VBox) SetLinkState(vm *VirtualMachine, index int, up bool) error {
+	state := "off"
+	if up {
+		state = "on"
+	}
+
+	if _, err := vb.control(vm, fmt.Sprintf("setlinkstate%d", index), state); err != nil {
+		return err
+	}
+
+	if nic := vm.nic(index); nic != nil {
+		nic.CableConnected = up
+	}
+	return nil
+}
+
+// ReattachNIC moves nic index of a running vm to network, attached in mode. network is ignored for nat and null
+func (vb *VBox) ReattachNIC(vm *VirtualMachine, index int, mode NetworkMode, network string) error {
+	args := []string{fmt.Sprintf("nic%d", index), string(mode)}
+	switch mode {
+	case NWMode_nat, NWMode_null:
+	case NWMode_bridged, NWMode_hostonly, NWMode_hostonlynet, NWMode_intnet, NWMode_natnetwork, NWMode_generic:
+		if network == "" {
+			return fmt.Errorf("network name is needed to attach a nic in mode %s", mode)
+		}
+		args = append(args, network)
+	default:
+		return fmt.Errorf("nic cannot be attached in mode %s", mode)
+	}
+
+	if _, err := vb.control(vm, args...); err != nil {
+		return err
+	}
+
+	if nic := vm.nic(index); nic != nil {
+		nic.Mode, nic.NetworkName = mode, network
+	}
+	return nil
+}
+
+// SetNICPromisc sets the promiscuous mode of nic index of a running vm, one of the PromiscMode_ values
+func (vb *VBox) SetNICPromisc(vm *VirtualMachine, index int, mode string) error {
+	if _, err := vb.control(vm, fmt.Sprintf("nicpromisc%d", index), mode); err != nil {
+		return err
+	}
+
+	if nic := vm.nic(index); nic != nil {
+		nic.PromiscuousMode = mode
+	}
+	return nil
+}
+
+// SetNICProperty sets a driver property of generic nic index, through controlvm when vm is running
+func (vb *VBox) SetNICProperty(vm *VirtualMachine, index int, key, value string) error {
+	running, err := vb.isRunning(vm)
+	if err != nil {
+		return err
+	}
+
+	prop := fmt.Sprintf("%s=%s", key, value)
+	if running {
+		_, err = vb.control(vm, fmt.Sprintf("nicproperty%d", index), prop)
+	} else {
+		_, err = vb.modify(vm, fmt.Sprintf("--nicproperty%d", index), prop)
+	}
+	if err != nil {
+		return err
+	}
+
+	if nic := vm.nic(index); nic != nil {
+		if nic.Properties == nil {
+			nic.Properties = map[string]string{}
+		}
+		nic.Properties[key] = value
+	}
+	return nil
+}
+
+// NewUDPTunnelNIC returns a generic nic sending its frames over udp from sport to dest:dport and receiving
+// them on sport
+func NewUDPTunnelNIC(sport int, dest string, dport int) NIC {
+	return NIC{
+		Mode:        NWMode_generic,
+		NetworkName: GenericDriver_UDPTunnel,
+		Properties: map[string]string{
+			"sport": strconv.Itoa(sport),
+			"dest":  dest,
+			"dport": strconv.Itoa(dport),
+		},
+	}
+}
+
+// NewUDPTunnelLink returns the two ends of a point to point link between two vms on this host, udp ports
+// portA and portB are used by either end
+func NewUDPTunnelLink(portA, portB int) (NIC, NIC) {
+	return NewUDPTunnelNIC(portA, "127.0.0.1", portB), NewUDPTunnelNIC(portB, "127.0.0.1", portA)
+}
+
+// NewVDENIC returns a generic nic plugged into the vde switch at network, the path of its control socket
+func NewVDENIC(network string) NIC {
+	return NIC{
+		Mode:        NWMode_generic,
+		NetworkName: GenericDriver_VDE,
+		Properties:  map[string]string{"network": network},
+	}
+}
+
+// sortedProperties renders properties as key=value, sorted by key for a stable command line
+func sortedProperties(props map[string]string) []string {
+	keys := make([]string, 0, len(props))
+	for k := range props {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	res := make([]string, 0, len(keys))
+	for _, k := range keys {
+		res = append(res, fmt.Sprintf("%s=%s", k, props[k]))
+	}
+	return res
+}
+
+// StartTrace captures the traffic of nic index of vm to file in pcap format, see ReadPcapFile. Traces of
+// running vms are started through controlvm, others take effect on the next start
+func (vb *VBox) StartTrace(vm *VirtualMachine, index int, file string) error {
+	return vb.setTrace(vm, index, "on", file)
+}
+
+// StopTrace stops capturing the traffic of nic index of vm
+func (vb *VBox) StopTrace(vm *VirtualMachine, index int) error {
+	return vb.setTrace(vm, index, "off", "")
+}
+
+func (vb *VBox) setTrace(vm *VirtualMachine, index int, state, file string) error {
+	running, err := vb.isRunning(vm)
+	if err != nil {
+		return err
+	}
+
+	if !running {
+		args := []string{fmt.Sprintf("--nictrace%d", index), state}
+		if file != "" {
+			args = append(args, fmt.Sprintf("--nictracefile%d", index), file)
+		}
+		_, err := vb.modify(vm, args...)
+		return err
+	}
+
+	// the file has to be switched before tracing is turned on
+	if file != "" {
+		if _, err := vb.control(vm, fmt.Sprintf("nictracefile%d", index), file); err != nil {
+			return err
+		}
+	}
+	_, err = vb.control(vm, fmt.Sprintf("nictrace%d", index), state)
+	return err
+}
+
 func (vb *VBox) SetNICDefaults(vm *VirtualMachine) error {
-	if err := vb.SyncNICs(); err != nil {
+	if _, err := vb.networks().Refresh(context.Background()); err != nil {
 		return err
 	}
 
@@ -228,24 +603,31 @@ func (vb *VBox) SetNICDefaults(vm *VirtualMachine) error {
 		nics[i].Index = i + 1 // will override the set index value
 
 		if nics[i].Mode == "" {
-			nics[i].Mode = NWMode_hostonly
+			nics[i].Mode = vb.HostOnlyMode()
 		}
 
 		if nics[i].Type == "" {
 			nics[i].Type = NIC_82540EM
 		}
 
-		if nics[i].NetworkName == "" {
-			if nics[i].Mode == NWMode_intnet {
-				verrs.Add(fmt.Sprintf("nic/%d", i), fmt.Errorf("networkname missing for internal net"))
+		if nics[i].PromiscuousMode == "" {
+			nics[i].PromiscuousMode = PromiscMode_deny
+		}
+
+		if _, named := nicNetworkKeys[nics[i].Mode]; named && nics[i].NetworkName == "" {
+			if nics[i].Mode == NWMode_intnet || nics[i].Mode == NWMode_generic {
+				verrs.Add(fmt.Sprintf("nic/%d", i), fmt.Errorf("networkname missing for %s", nics[i].Mode))
 				continue
 			}
 
-			if nw, err := vb.getDefaultNetwork(nics[i].Mode); err == nil {
-				nics[i].NetworkName = nw.Name
-			} else {
+			if nw, err := vb.getDefaultNetwork(nics[i].Mode); err != nil {
 				verrs.Add(fmt.Sprintf("nic/%d", i), err)
 				continue
+			} else if nw == nil {
+				verrs.Add(fmt.Sprintf("nic/%d", i), fmt.Errorf("no %s network found to default to", nics[i].Mode))
+				continue
+			} else {
+				nics[i].NetworkName = nw.Name
 			}
 		}
 	}
@@ -253,60 +635,263 @@ func (vb *VBox) SetNICDefaults(vm *VirtualMachine) error {
 	if len(verrs.errors) > 0 {
 		return verrs
 	}
+
+	if vb.Config.MACAllocation != nil {
+		return vb.allocateMACs(vm)
+	}
 	return nil
 }
 
 func (vb *VBox) getNetwork(nw string, mode NetworkMode) (*Network, error) {
-	switch mode {
-	case NWMode_bridged:
-		return vb.BridgedNws[nw], nil
-	case NWMode_hostonly:
-		return vb.HostOnlyNws[nw], nil
-	case NWMode_intnet:
-		return vb.InternalNws[nw], nil
-	case NWMode_natnetwork:
-		return vb.NatNws[nw], nil
-	default:
-		return nil, nil
-	}
+	n, _ := vb.networks().Get(mode, nw)
+	return n, nil
 }
 
 func (vb *VBox) getDefaultNetwork(mode NetworkMode) (*Network, error) {
-	var nws []*Network
-	switch mode {
-	case NWMode_bridged:
-		nws = make([]*Network, 0, len(vb.BridgedNws))
-		for _, v := range vb.BridgedNws {
-			nws = append(nws, v)
+	if nws := vb.networks().ByMode(mode); len(nws) > 0 {
+		return nws[0], nil
+	}
+	return nil, nil
+}
+
+// NetworkReport lists the networks that were changed on the host by EnsureNets
+type NetworkReport struct {
+	Created []Network
+	Updated []Network
+	Removed []Network
+}
+
+// managedNetKeyPrefix is the global extradata namespace used to mark networks created by EnsureNets. Declared
+// networks that already existed are left unmarked so that pruning never removes them.
+// The value of each key is the name of the network on the host, which for hostonly interfaces may differ
+// from the declared name since virtualbox picks the interface name on creation
+const managedNetKeyPrefix = "virtualbox-go/networks/"
+
+func managedNetKey(mode NetworkMode, name string) string {
+	return fmt.Sprintf("%s%s/%s", managedNetKeyPrefix, mode, name)
+}
+
+// EnsureNets converges the host networks to Config.Networks. Missing hostonly interfaces and nat networks are
+// created, drifted addresses are reconfigured and, if prune is set, networks previously created by this tool
+// that are no longer declared are removed
+func (vb *VBox) EnsureNets(context context.Context, prune bool) (*NetworkReport, error) {
+	if _, err := vb.networks().ForceRefresh(context); err != nil {
+		return nil, err
+	}
+
+	markers, err := vb.globalExtraData(managedNetKeyPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &NetworkReport{}
+	declared := map[string]bool{}
+
+	for i := range vb.Config.Networks {
+		decl := vb.Config.Networks[i]
+		path := fmt.Sprintf("network/%d", i)
+
+		if decl.Mode == "" {
+			decl.Mode = vb.HostOnlyMode()
 		}
-	case NWMode_hostonly:
-		nws = make([]*Network, 0, len(vb.HostOnlyNws))
-		for _, v := range vb.HostOnlyNws {
-			nws = append(nws, v)
+		if decl.Name == "" {
+			return report, ValidationError{Path: path, Err: fmt.Errorf("network name is empty")}
 		}
-	case NWMode_intnet:
-		nws = make([]*Network, 0, len(vb.InternalNws))
-		for _, v := range vb.InternalNws {
-			nws = append(nws, v)
+
+		key := managedNetKey(decl.Mode, decl.Name)
+		declared[key] = true
+
+		// hostonly interfaces created earlier may carry a name picked by virtualbox
+		if marked, ok := markers[key]; ok && decl.Mode == NWMode_hostonly {
+			decl.Name = marked
 		}
-	case NWMode_natnetwork:
-		nws = make([]*Network, 0, len(vb.NatNws))
-		for _, v := range vb.NatNws {
-			nws = append(nws, v)
+		allocName := decl.Name
+
+		if vb.Config.IPAM != nil {
+			if err := vb.AllocateSubnet(&decl); err != nil {
+				return report, OperationError{Path: path, Op: "allocate", Err: err}
+			}
+		}
+
+		created := len(report.Created)
+		var err error
+		switch decl.Mode {
+		case NWMode_hostonly:
+			err = vb.ensureHostOnlyNet(&decl, report)
+		case NWMode_hostonlynet:
+			err = vb.ensureHostOnlyNetwork(&decl, report)
+		case NWMode_natnetwork:
+			err = vb.ensureNatNet(&decl, report)
+		default:
+			err = fmt.Errorf("networks of mode %s cannot be managed", decl.Mode)
+		}
+		if err != nil {
+			return report, OperationError{Path: path, Op: "ensure", Err: err}
+		}
+
+		if vb.Config.IPAM != nil && decl.Name != allocName {
+			if err := vb.renameSubnet(allocName, decl.Name); err != nil {
+				return report, OperationError{Path: path, Op: "allocate", Err: err}
+			}
+		}
+
+		if _, managed := markers[key]; managed || len(report.Created) > created {
+			if err := vb.setGlobalExtraData(key, decl.Name); err != nil {
+				return report, OperationError{Path: path, Op: "mark", Err: err}
+			}
 		}
 	}
 
-	sort.Slice(nws, func(i, j int) bool {
-		return nws[i].Name < nws[j].Name
-	})
+	if !prune {
+		return report, nil
+	}
 
-	if len(nws) > 0 {
-		return nws[0], nil
+	for key, name := range markers {
+		if declared[key] {
+			continue
+		}
+
+		mode := NetworkMode(strings.SplitN(strings.TrimPrefix(key, managedNetKeyPrefix), "/", 2)[0])
+		nw := Network{Name: name, Mode: mode}
+		if err := vb.DeleteNet(&nw); err != nil && !IsNotFoundError(err) {
+			return report, OperationError{Path: key, Op: "prune", Err: err}
+		}
+
+		vb.networks().Delete(mode, name)
+
+		if vb.Config.IPAM != nil {
+			if err := vb.ReleaseSubnet(name); err != nil {
+				return report, OperationError{Path: key, Op: "release", Err: err}
+			}
+		}
+
+		if err := vb.deleteGlobalExtraData(key); err != nil {
+			return report, OperationError{Path: key, Op: "unmark", Err: err}
+		}
+		report.Removed = append(report.Removed, nw)
 	}
 
-	return nil, nil
+	return report, nil
 }
 
-func (vb *VBox) EnsureNets() error {
+// ensureHostOnlyNet resolves decl to an existing hostonly interface by name and creates one when it does not
+// exist. decl.Name is updated to the interface name picked by virtualbox on creation
+func (vb *VBox) ensureHostOnlyNet(decl *Network, report *NetworkReport) error {
+	existing, ok := vb.networks().Get(NWMode_hostonly, decl.Name)
+	if !ok {
+		if err := vb.CreateNet(decl); err != nil {
+			return err
+		}
+		if decl.IPNet.IP != nil {
+			if err := vb.setHostOnlyNetAddress(decl); err != nil {
+				return err
+			}
+		}
+		vb.networks().Put(*decl)
+		report.Created = append(report.Created, *decl)
+		return nil
+	}
+
+	decl.Name = existing.Name
+	if decl.IPNet.IP == nil || ipNetEqual(subnetOf(decl.IPNet), subnetOf(existing.IPNet)) {
+		return nil
+	}
+
+	if err := vb.setHostOnlyNetAddress(decl); err != nil {
+		return err
+	}
+	updated := *existing
+	updated.IPNet = decl.IPNet
+	vb.networks().Put(updated)
+	report.Updated = append(report.Updated, updated)
 	return nil
 }
+
+func (vb *VBox) setHostOnlyNetAddress(nw *Network) error {
+	ip := hostOnlyNetAddress(nw.IPNet)
+
+	var err error
+	if ip.To4() != nil {
+		_, err = vb.manage("hostonlyif", "ipconfig", nw.Name, "--ip", ip.String(),
+			"--netmask", net.IP(nw.IPNet.Mask).String())
+	} else {
+		ones, _ := nw.IPNet.Mask.Size()
+		_, err = vb.manage("hostonlyif", "ipconfig", nw.Name, "--ipv6", ip.String(),
+			"--netmasklengthv6", strconv.Itoa(ones))
+	}
+	return err
+}
+
+func (vb *VBox) ensureHostOnlyNetwork(decl *Network, report *NetworkReport) error {
+	existing, ok := vb.networks().Get(NWMode_hostonlynet, decl.Name)
+	if !ok {
+		if err := vb.createHostOnlyNetwork(decl); err != nil {
+			return err
+		}
+		vb.networks().Put(*decl)
+		report.Created = append(report.Created, *decl)
+		return nil
+	}
+
+	want, have := hostOnlyNetworkArgs(decl), hostOnlyNetworkArgs(existing)
+	if want == nil || strings.Join(want, " ") == strings.Join(have, " ") {
+		return nil
+	}
+
+	if _, err := vb.manage(append([]string{"hostonlynet", "modify", "--name", decl.Name}, want...)...); err != nil {
+		return err
+	}
+	updated := *existing
+	updated.IPNet, updated.LowerIP, updated.UpperIP = decl.IPNet, decl.LowerIP, decl.UpperIP
+	vb.networks().Put(updated)
+	report.Updated = append(report.Updated, updated)
+	return nil
+}
+
+func (vb *VBox) ensureNatNet(decl *Network, report *NetworkReport) error {
+	if decl.IPNet.IP == nil {
+		return fmt.Errorf("nat network %s needs an IPNet", decl.Name)
+	}
+	cidr := (&net.IPNet{IP: decl.IPNet.IP.Mask(decl.IPNet.Mask), Mask: decl.IPNet.Mask}).String()
+
+	existing, ok := vb.networks().Get(NWMode_natnetwork, decl.Name)
+	if !ok {
+		if _, err := vb.manage("natnetwork", "add", "--netname", decl.Name, "--network", cidr, "--enable"); err != nil {
+			return err
+		}
+		vb.networks().Put(*decl)
+		report.Created = append(report.Created, *decl)
+		return nil
+	}
+
+	if ipNetEqual(existing.IPNet, decl.IPNet) {
+		return nil
+	}
+
+	if _, err := vb.manage("natnetwork", "modify", "--netname", decl.Name, "--network", cidr); err != nil {
+		return err
+	}
+	updated := *existing
+	updated.IPNet = decl.IPNet
+	vb.networks().Put(updated)
+	report.Updated = append(report.Updated, updated)
+	return nil
+}
+
+func ipNetEqual(a, b net.IPNet) bool {
+	return a.IP.Equal(b.IP) && bytes.Equal(a.Mask, b.Mask)
+}
+
+// hostOnlyNetAddress is the host address of a hostonly interface declared with ipnet. Declarations giving the
+// subnet, e.g 192.168.60.0/24, get the first address of it like the subnets carved by IPAM
+func hostOnlyNetAddress(ipnet net.IPNet) net.IP {
+	if subnet := subnetOf(ipnet); ipnet.IP.Equal(subnet.IP) {
+		return ipAdd(subnet.IP, 1)
+	}
+	return ipnet.IP
+}
+
+// subnetOf returns the network ipnet is part of, e.g 192.168.60.0/24 for 192.168.60.1/24
+func subnetOf(ipnet net.IPNet) net.IPNet {
+	return net.IPNet{IP: ipnet.IP.Mask(ipnet.Mask), Mask: ipnet.Mask}
+}
@@ -4,6 +4,8 @@ import (
 	"context"
 	"fmt"
 	diff "gopkg.in/d4l3k/messagediff.v1"
+	"net"
+	"strings"
 	"testing"
 	"time"
 )
@@ -78,8 +80,8 @@ func TestSetNetDefaults(t *testing.T) {
 
 	for i := range vm.Spec.NICs {
 		nic := &vm.Spec.NICs[i]
-		if nic.Mode != NWMode_hostonly {
-			t.Errorf("expected %s, got %s", NWMode_hostonly, nic.Mode)
+		if nic.Mode != vb.HostOnlyMode() {
+			t.Errorf("expected %s, got %s", vb.HostOnlyMode(), nic.Mode)
 		}
 
 		if nic.NetworkName == "" {
@@ -110,7 +112,7 @@ func TestSyncetwork(t *testing.T) {
 	}
 
 	//alteast we should find the network we created
-	if nw1, ok := vb.HostOnlyNws[network.Name]; !ok {
+	if nw1, ok := vb.Networks.Get(NWMode_hostonly, network.Name); !ok {
 		t.Fatalf("error syncing %#v", err)
 	} else {
 		if network.Name != nw1.Name {
@@ -168,3 +170,220 @@ func TestVBox_Ensure(t *testing.T) {
 		t.Logf("%s", diff) // we need to fix these diffs
 	}
 }
+
+func TestVBox_EnsureNets(t *testing.T) {
+	_, ipnet, _ := net.ParseCIDR("10.200.0.0/24")
+
+	// Object under test
+	vb := NewVBox(Config{
+		Networks: []Network{
+			{Name: "vbgtestnat0", Mode: NWMode_natnetwork, IPNet: *ipnet},
+		},
+	})
+
+	report, err := vb.EnsureNets(context.Background(), false)
+	if err != nil {
+		t.Fatalf("error ensuring nets %#v", err)
+	}
+	defer vb.DeleteNet(&vb.Config.Networks[0])
+
+	if len(report.Created)+len(report.Updated) == 0 {
+		t.Logf("network already converged %#v", report)
+	}
+
+	// a second run must be a no op
+	report, err = vb.EnsureNets(context.Background(), false)
+	if err != nil {
+		t.Fatalf("error ensuring nets %#v", err)
+	}
+	if len(report.Created) != 0 || len(report.Updated) != 0 {
+		t.Errorf("expected no changes, got %#v", report)
+	}
+
+	// dropping the declaration and pruning removes the network it created
+	vb.Config.Networks = nil
+	report, err = vb.EnsureNets(context.Background(), true)
+	if err != nil {
+		t.Fatalf("error pruning nets %#v", err)
+	}
+	if len(report.Removed) != 1 || report.Removed[0].Name != "vbgtestnat0" {
+		t.Errorf("expected vbgtestnat0 to be pruned, got %#v", report)
+	}
+}
+
+func TestHostOnlyNetAddress(t *testing.T) {
+	for cidr, expected := range map[string]string{"192.168.60.0/24": "192.168.60.1", "192.168.60.5/24": "192.168.60.5"} {
+		ip, ipnet, _ := net.ParseCIDR(cidr)
+		if actual := hostOnlyNetAddress(net.IPNet{IP: ip, Mask: ipnet.Mask}); actual.String() != expected {
+			t.Errorf("expected host address %s for %s, got %s", expected, cidr, actual)
+		}
+	}
+
+	// a declared subnet matches the listed interface address
+	_, decl, _ := net.ParseCIDR("192.168.60.0/24")
+	listed := net.IPNet{IP: net.ParseIP("192.168.60.1"), Mask: net.IPMask(net.ParseIP("255.255.255.0").To4())}
+	if !ipNetEqual(subnetOf(*decl), subnetOf(listed)) {
+		t.Errorf("expected %s and %s to be the same network", decl, listed.String())
+	}
+}
+
+func TestHostOnlyNetworkArgs(t *testing.T) {
+	_, ipnet, _ := net.ParseCIDR("192.168.64.0/24")
+
+	nw := &Network{Name: "HostNet", Mode: NWMode_hostonlynet, IPNet: *ipnet}
+	expected := "--netmask 255.255.255.0 --lower-ip 192.168.64.1 --upper-ip 192.168.64.254"
+	if args := strings.Join(hostOnlyNetworkArgs(nw), " "); args != expected {
+		t.Errorf("expected %s, got %s", expected, args)
+	}
+
+	nw.LowerIP = net.ParseIP("192.168.64.100")
+	expected = "--netmask 255.255.255.0 --lower-ip 192.168.64.100 --upper-ip 192.168.64.254"
+	if args := strings.Join(hostOnlyNetworkArgs(nw), " "); args != expected {
+		t.Errorf("expected %s, got %s", expected, args)
+	}
+}
+
+func TestVBox_ReconfigureRunningNIC(t *testing.T) {
+	// Object under test
+	vb := NewVBox(Config{})
+
+	vm := &VirtualMachine{}
+	vm.Spec.Name = "testvm-nics"
+	vm.Spec.Group = "/tess"
+	vm.Spec.OSType = Linux64
+	vm.Spec.CPU.Count = 1
+	vm.Spec.Memory.SizeMB = 256
+	vm.Spec.NICs = []NIC{{Mode: NWMode_intnet, NetworkName: "intnet0"}}
+
+	vb.EnsureDefaults(vm)
+
+	vb.UnRegisterVM(vm)
+	vb.DeleteVM(vm)
+
+	defer vb.DeleteVM(vm)
+	defer vb.UnRegisterVM(vm)
+
+	if _, err := vb.Define(context.Background(), vm); err != nil {
+		t.Fatalf("Error defining %#v", err)
+	}
+
+	if _, err := vb.Start(vm); err != nil {
+		t.Fatalf("Failed to start vm %s, error %v", vm.Spec.Name, err)
+	}
+	defer vb.Stop(vm)
+
+	if err := vb.SetLinkState(vm, 1, false); err != nil {
+		t.Errorf("Failed to pull cable %v", err)
+	}
+	if err := vb.ReattachNIC(vm, 1, NWMode_intnet, "intnet1"); err != nil {
+		t.Errorf("Failed to reattach nic %v", err)
+	}
+	if err := vb.SetNICPromisc(vm, 1, PromiscMode_allowall); err != nil {
+		t.Errorf("Failed to set promiscuous mode %v", err)
+	}
+
+	if nic := vm.Spec.NICs[0]; nic.CableConnected || nic.NetworkName != "intnet1" || nic.PromiscuousMode != PromiscMode_allowall {
+		t.Errorf("spec not updated, got %#v", nic)
+	}
+}
+
+func TestParseBandwidthGroup(t *testing.T) {
+	group, err := parseBandwidthGroup("Limit,2,Network,20M")
+	if err != nil {
+		t.Fatalf("error parsing %v", err)
+	}
+
+	expected := BandwidthGroup{Name: "Limit,2", Type: BandwidthGroup_network, Limit: 20 * MBps}
+	if group != expected {
+		t.Errorf("expected %#v, got %#v", expected, group)
+	}
+
+	// lower case units are bits
+	if limit, err := parseBandwidthLimit("80m"); err != nil || limit != 10*1000*1000 {
+		t.Errorf("expected 80 megabits to be 10000000 bytes, got %d %v", limit, err)
+	}
+
+	if limit := formatBandwidthLimit(group.Limit); limit != "20M" {
+		t.Errorf("expected 20M, got %s", limit)
+	}
+	if limit := formatBandwidthLimit(1536 * KBps); limit != "1536K" {
+		t.Errorf("expected 1536K, got %s", limit)
+	}
+}
+
+func TestParseNICs(t *testing.T) {
+	m := map[string]interface{}{
+		"nic1": "bridged", "bridgeadapter1": "en0", "macaddress1": "080027000001", "cableconnected1": "on", "nictype1": "82540EM", "nicspeed1": "0",
+		"nic2": "intnet", "intnet2": "intnet0", "macaddress2": "080027000002", "cableconnected2": "off", "nictype2": "virtio", "nicspeed2": "1000",
+		"nic3": "natnetwork", "nat-network3": "NatNetwork",
+		"nic4": "generic", "generic4": "UDPTunnel",
+		"nic5": "none",
+		"nic6": "nat", "natnet6": "nat",
+	}
+
+	settings := &vmSettingsXML{Adapters: []adapterSettingsXML{
+		{Slot: 1, BootPriority: 1, PromiscuousModePolicy: "AllowAll"},
+		{Slot: 3},
+	}}
+	settings.Adapters[1].GenericInterface.Driver = "UDPTunnel"
+	settings.Adapters[1].GenericInterface.Properties = []propertySettingsXML{{Name: "dport", Value: "10001"}}
+
+	nics := parseNICs(m, settings)
+
+	expected := []NIC{
+		{Index: 1, Mode: NWMode_bridged, NetworkName: "en0", Type: NIC_82540EM, CableConnected: true, MAC: "080027000001", PromiscuousMode: PromiscMode_deny},
+		{Index: 2, Mode: NWMode_intnet, NetworkName: "intnet0", Type: NIC_virtio, Speedkbps: 1000, MAC: "080027000002", BootPrio: 1, PromiscuousMode: PromiscMode_allowall},
+		{Index: 3, Mode: NWMode_natnetwork, NetworkName: "NatNetwork", PromiscuousMode: PromiscMode_deny},
+		{Index: 4, Mode: NWMode_generic, NetworkName: "UDPTunnel", PromiscuousMode: PromiscMode_deny, Properties: map[string]string{"dport": "10001"}},
+		{Index: 6, Mode: NWMode_nat, PromiscuousMode: PromiscMode_deny},
+	}
+
+	if d, equal := diff.PrettyDiff(expected, nics); !equal {
+		t.Errorf("nics not parsed as expected\n%s", d)
+	}
+}
+
+func TestNewUDPTunnelLink(t *testing.T) {
+	a, b := NewUDPTunnelLink(10001, 10002)
+
+	if a.Mode != NWMode_generic || a.NetworkName != GenericDriver_UDPTunnel {
+		t.Errorf("expected a udp tunnel nic, got %#v", a)
+	}
+
+	expected := "dest=127.0.0.1 dport=10002 sport=10001"
+	if props := strings.Join(sortedProperties(a.Properties), " "); props != expected {
+		t.Errorf("expected %s, got %s", expected, props)
+	}
+
+	if a.Properties["sport"] != b.Properties["dport"] || a.Properties["dport"] != b.Properties["sport"] {
+		t.Errorf("ends do not mirror each other, got %#v and %#v", a.Properties, b.Properties)
+	}
+}
+
+func TestDeriveMAC(t *testing.T) {
+	oui, err := (&MACAllocationConfig{}).oui()
+	if err != nil {
+		t.Fatalf("error parsing default oui %v", err)
+	}
+
+	mac1, _ := deriveMAC(oui, "vm01", 1, map[string]bool{})
+	mac2, _ := deriveMAC(oui, "vm01", 1, map[string]bool{})
+	if mac1 != mac2 || !strings.HasPrefix(mac1, strings.ToUpper(normalizeMAC(DefaultOUI))) || len(mac1) != 12 {
+		t.Errorf("expected a stable mac under %s, got %s and %s", DefaultOUI, mac1, mac2)
+	}
+
+	other, _ := deriveMAC(oui, "vm01", 2, map[string]bool{})
+	if other == mac1 {
+		t.Errorf("expected different macs per nic, got %s", other)
+	}
+
+	// a collision moves on to another mac
+	rehashed, _ := deriveMAC(oui, "vm01", 1, map[string]bool{normalizeMAC(mac1): true})
+	if rehashed == mac1 {
+		t.Errorf("expected collision with %s to be avoided", mac1)
+	}
+
+	if _, err := (&MACAllocationConfig{OUI: "01:00:5e"}).oui(); err == nil {
+		t.Errorf("expected multicast oui to be rejected")
+	}
+}
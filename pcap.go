@@ -0,0 +1,193 @@
+package virtualbox
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"time"
+)
+
+const (
+	pcapMagicMicros = 0xa1b2c3d4
+	pcapMagicNanos  = 0xa1b23c4d
+
+	pcapGlobalHeaderLen = 24
+	pcapRecordHeaderLen = 16
+	// pcapMaxSnapLen caps the record length when the header declares no snap length or a larger one, as libpcap does
+	pcapMaxSnapLen = 262144
+
+	EtherTypeIPv4 = 0x0800
+	EtherTypeARP  = 0x0806
+	EtherTypeIPv6 = 0x86dd
+
+	ARPRequest = 1
+	ARPReply   = 2
+)
+
+var errTruncatedPcapRecord = errors.New("truncated pcap record")
+
+// Packet is a frame captured by a nic trace
+type Packet struct {
+	Timestamp time.Time
+	// Data holds the captured bytes, which may be shorter than OrigLen when the capture was truncated
+	Data    []byte
+	OrigLen int
+}
+
+// EthernetFrame is the decoded ethernet header of a packet
+type EthernetFrame struct {
+	Dst       net.HardwareAddr
+	Src       net.HardwareAddr
+	EtherType uint16
+	Payload   []byte
+}
+
+// ARPPacket is a decoded ipv4 over ethernet arp packet
+type ARPPacket struct {
+	Op        uint16
+	SenderMAC net.HardwareAddr
+	SenderIP  net.IP
+	TargetMAC net.HardwareAddr
+	TargetIP  net.IP
+}
+
+// PcapReader reads packets from the libpcap files written by nic traces
+type PcapReader struct {
+	r        io.Reader
+	order    binary.ByteOrder
+	nanos    bool
+	LinkType uint32
+	SnapLen  uint32
+}
+
+func NewPcapReader(r io.Reader) (*PcapReader, error) {
+	hdr := make([]byte, pcapGlobalHeaderLen)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, fmt.Errorf("cannot read pcap header: %v", err)
+	}
+
+	p := &PcapReader{r: r}
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		switch order.Uint32(hdr[0:4]) {
+		case pcapMagicMicros:
+			p.order = order
+		case pcapMagicNanos:
+			p.order, p.nanos = order, true
+		}
+		if p.order != nil {
+			break
+		}
+	}
+	if p.order == nil {
+		return nil, fmt.Errorf("not a pcap file, magic %x", hdr[0:4])
+	}
+
+	p.SnapLen = p.order.Uint32(hdr[16:20])
+	p.LinkType = p.order.Uint32(hdr[20:24])
+	return p, nil
+}
+
+// Next returns the next packet, or io.EOF once all packets have been read
+func (p *PcapReader) Next() (*Packet, error) {
+	hdr := make([]byte, pcapRecordHeaderLen)
+	if _, err := io.ReadFull(p.r, hdr); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, errTruncatedPcapRecord
+		}
+		return nil, err
+	}
+
+	secs := int64(p.order.Uint32(hdr[0:4]))
+	frac := int64(p.order.Uint32(hdr[4:8]))
+	if !p.nanos {
+		frac *= 1000
+	}
+
+	inclLen := p.order.Uint32(hdr[8:12])
+	if limit := p.snapLen(); inclLen > limit {
+		return nil, fmt.Errorf("pcap record of %d bytes exceeds the snap length of %d", inclLen, limit)
+	}
+
+	pkt := &Packet{
+		Timestamp: time.Unix(secs, frac),
+		Data:      make([]byte, inclLen),
+		OrigLen:   int(p.order.Uint32(hdr[12:16])),
+	}
+	if _, err := io.ReadFull(p.r, pkt.Data); err == io.EOF || err == io.ErrUnexpectedEOF {
+		return nil, errTruncatedPcapRecord
+	} else if err != nil {
+		return nil, err
+	}
+	return pkt, nil
+}
+
+func (p *PcapReader) snapLen() uint32 {
+	if p.SnapLen == 0 || p.SnapLen > pcapMaxSnapLen {
+		return pcapMaxSnapLen
+	}
+	return p.SnapLen
+}
+
+// ReadPcapFile reads all packets of a trace file. Traces of running vms can be read while being written,
+// a partially written last record is dropped
+func ReadPcapFile(path string) ([]Packet, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r, err := NewPcapReader(f)
+	if err != nil {
+		return nil, err
+	}
+
+	var pkts []Packet
+	for {
+		pkt, err := r.Next()
+		if err == io.EOF || err == errTruncatedPcapRecord {
+			return pkts, nil
+		} else if err != nil {
+			return pkts, err
+		}
+		pkts = append(pkts, *pkt)
+	}
+}
+
+// Ethernet decodes the ethernet header of the packet, ok is false for runts
+func (pkt *Packet) Ethernet() (frame EthernetFrame, ok bool) {
+	if len(pkt.Data) < 14 {
+		return frame, false
+	}
+	return EthernetFrame{
+		Dst:       net.HardwareAddr(pkt.Data[0:6]),
+		Src:       net.HardwareAddr(pkt.Data[6:12]),
+		EtherType: binary.BigEndian.Uint16(pkt.Data[12:14]),
+		Payload:   pkt.Data[14:],
+	}, true
+}
+
+// ARP decodes the packet as an ipv4 over ethernet arp packet, ok is false for any other packet
+func (pkt *Packet) ARP() (arp ARPPacket, ok bool) {
+	frame, ok := pkt.Ethernet()
+	if !ok || frame.EtherType != EtherTypeARP || len(frame.Payload) < 28 {
+		return arp, false
+	}
+
+	b := frame.Payload
+	// hardware type ethernet, protocol ipv4, address lengths 6 and 4
+	if binary.BigEndian.Uint16(b[0:2]) != 1 || binary.BigEndian.Uint16(b[2:4]) != EtherTypeIPv4 || b[4] != 6 || b[5] != 4 {
+		return arp, false
+	}
+
+	return ARPPacket{
+		Op:        binary.BigEndian.Uint16(b[6:8]),
+		SenderMAC: net.HardwareAddr(b[8:14]),
+		SenderIP:  net.IP(b[14:18]),
+		TargetMAC: net.HardwareAddr(b[18:24]),
+		TargetIP:  net.IP(b[24:28]),
+	}, true
+}
@@ -0,0 +1,67 @@
+package virtualbox
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestPcapReader(t *testing.T) {
+	senderMAC, _ := net.ParseMAC("08:00:27:00:00:01")
+
+	// an arp request from 10.0.0.10 for 10.0.0.11
+	frame := append([]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, senderMAC...)
+	frame = append(frame, 0x08, 0x06)
+	frame = append(frame, 0, 1, 0x08, 0x00, 6, 4, 0, ARPRequest)
+	frame = append(frame, senderMAC...)
+	frame = append(frame, 10, 0, 0, 10)
+	frame = append(frame, 0, 0, 0, 0, 0, 0)
+	frame = append(frame, 10, 0, 0, 11)
+
+	var buf bytes.Buffer
+	le := binary.LittleEndian
+	binary.Write(&buf, le, []uint32{pcapMagicMicros, 0x00040002, 0, 0, 65535, 1})
+	binary.Write(&buf, le, []uint32{1541452230, 500, uint32(len(frame)), uint32(len(frame))})
+	buf.Write(frame)
+
+	r, err := NewPcapReader(&buf)
+	if err != nil {
+		t.Fatalf("error reading header %v", err)
+	}
+	if r.LinkType != 1 {
+		t.Errorf("expected ethernet link type, got %d", r.LinkType)
+	}
+
+	pkt, err := r.Next()
+	if err != nil {
+		t.Fatalf("error reading packet %v", err)
+	}
+	if pkt.Timestamp.Unix() != 1541452230 || pkt.Timestamp.Nanosecond() != 500000 {
+		t.Errorf("timestamp not parsed as expected, got %v", pkt.Timestamp)
+	}
+
+	arp, ok := pkt.ARP()
+	if !ok {
+		t.Fatalf("expected an arp packet")
+	}
+	if arp.Op != ARPRequest || arp.SenderMAC.String() != senderMAC.String() || !arp.TargetIP.Equal(net.ParseIP("10.0.0.11")) {
+		t.Errorf("arp not decoded as expected, got %#v", arp)
+	}
+
+	if _, err := r.Next(); err != io.EOF {
+		t.Errorf("expected EOF, got %v", err)
+	}
+
+	// a corrupt record length is refused instead of allocated
+	buf.Reset()
+	binary.Write(&buf, le, []uint32{pcapMagicMicros, 0x00040002, 0, 0, 65535, 1})
+	binary.Write(&buf, le, []uint32{1541452230, 500, 0xffffffff, 0xffffffff})
+	if r, err = NewPcapReader(&buf); err != nil {
+		t.Fatalf("error reading header %v", err)
+	}
+	if _, err := r.Next(); err == nil {
+		t.Errorf("expected a record longer than the snap length to be refused")
+	}
+}
@@ -0,0 +1,185 @@
+package virtualbox
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DefaultNetworkCacheTTL is how long a NetworkRegistry serves networks before Refresh lists them again
+const DefaultNetworkCacheTTL = 30 * time.Second
+
+// NetworkChanges lists the networks that appeared or disappeared between two refreshes of a NetworkRegistry
+type NetworkChanges struct {
+	Added   []Network
+	Removed []Network
+}
+
+// Empty is true when no network was added or removed
+func (c *NetworkChanges) Empty() bool {
+	return len(c.Added) == 0 && len(c.Removed) == 0
+}
+
+type networkKey struct {
+	mode NetworkMode
+	name string
+}
+
+// NetworkRegistry holds the networks of the host, including the ones created out of band (not through this
+// api). Networks are keyed by mode and name, the same name may be used by networks of different modes
+type NetworkRegistry struct {
+	// TTL is how long listed networks are served by Refresh, 0 lists on every Refresh
+	TTL time.Duration
+
+	list func() ([]Network, error)
+
+	mu        sync.RWMutex
+	nws       map[networkKey]*Network
+	refreshed time.Time
+}
+
+// NewNetworkRegistry returns a registry populated by list
+func NewNetworkRegistry(list func() ([]Network, error), ttl time.Duration) *NetworkRegistry {
+	return &NetworkRegistry{
+		TTL:  ttl,
+		list: list,
+		nws:  make(map[networkKey]*Network),
+	}
+}
+
+// Refresh lists the host networks unless the last listing is younger than TTL, in which case the returned
+// changes are empty
+func (r *NetworkRegistry) Refresh(ctx context.Context) (*NetworkChanges, error) {
+	r.mu.RLock()
+	fresh := !r.refreshed.IsZero() && time.Since(r.refreshed) < r.TTL
+	r.mu.RUnlock()
+	if fresh {
+		return &NetworkChanges{}, nil
+	}
+	return r.ForceRefresh(ctx)
+}
+
+// ForceRefresh lists the host networks regardless of TTL and returns the networks added and removed since the
+// previous listing. The first listing reports all networks as added
+func (r *NetworkRegistry) ForceRefresh(ctx context.Context) (*NetworkChanges, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	listed, err := r.list()
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	nws := make(map[networkKey]*Network, len(listed))
+	for i := range listed {
+		nws[networkKey{listed[i].Mode, listed[i].Name}] = &listed[i]
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	changes := &NetworkChanges{}
+	for k, nw := range nws {
+		if _, ok := r.nws[k]; !ok {
+			changes.Added = append(changes.Added, *nw)
+		}
+	}
+	for k, nw := range r.nws {
+		if _, ok := nws[k]; !ok {
+			changes.Removed = append(changes.Removed, *nw)
+		}
+	}
+	sortNetworks(changes.Added)
+	sortNetworks(changes.Removed)
+
+	r.nws = nws
+	r.refreshed = time.Now()
+	return changes, nil
+}
+
+// Invalidate makes the next Refresh list the host networks
+func (r *NetworkRegistry) Invalidate() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.refreshed = time.Time{}
+}
+
+// Get returns the network of mode named name. The returned network is shared with other readers and must not be
+// changed, use Put to record changes
+func (r *NetworkRegistry) Get(mode NetworkMode, name string) (*Network, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	nw, ok := r.nws[networkKey{mode, name}]
+	return nw, ok
+}
+
+// ByName returns the networks of any mode named name, sorted by mode
+func (r *NetworkRegistry) ByName(name string) []*Network {
+	return r.filter(func(nw *Network) bool { return nw.Name == name })
+}
+
+// ByMode returns the networks of mode, sorted by name
+func (r *NetworkRegistry) ByMode(mode NetworkMode) []*Network {
+	return r.filter(func(nw *Network) bool { return nw.Mode == mode })
+}
+
+// ByGUID returns the network with guid. Only hostonly and bridged interfaces carry a guid
+func (r *NetworkRegistry) ByGUID(guid string) (*Network, bool) {
+	if guid == "" {
+		return nil, false
+	}
+	nws := r.filter(func(nw *Network) bool { return nw.GUID == guid })
+	if len(nws) == 0 {
+		return nil, false
+	}
+	return nws[0], true
+}
+
+// All returns every network, sorted by mode and name
+func (r *NetworkRegistry) All() []*Network {
+	return r.filter(func(*Network) bool { return true })
+}
+
+// Put records a network created through this api without waiting for the next listing
+func (r *NetworkRegistry) Put(nw Network) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.nws[networkKey{nw.Mode, nw.Name}] = &nw
+}
+
+// Delete forgets a network removed through this api without waiting for the next listing
+func (r *NetworkRegistry) Delete(mode NetworkMode, name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.nws, networkKey{mode, name})
+}
+
+func (r *NetworkRegistry) filter(match func(*Network) bool) []*Network {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var nws []*Network
+	for _, nw := range r.nws {
+		if match(nw) {
+			nws = append(nws, nw)
+		}
+	}
+	sort.Slice(nws, func(i, j int) bool { return networkLess(nws[i], nws[j]) })
+	return nws
+}
+
+func sortNetworks(nws []Network) {
+	sort.Slice(nws, func(i, j int) bool { return networkLess(&nws[i], &nws[j]) })
+}
+
+func networkLess(a, b *Network) bool {
+	if a.Mode != b.Mode {
+		return a.Mode < b.Mode
+	}
+	return a.Name < b.Name
+}
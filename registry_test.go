@@ -0,0 +1,96 @@
+package virtualbox
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestNetworkRegistry(t *testing.T) {
+	listed := []Network{
+		{Name: "vboxnet1", Mode: NWMode_hostonly, GUID: "786f6276-656e-4174-8000-0a0027000001"},
+		{Name: "vboxnet0", Mode: NWMode_hostonly, GUID: "786f6276-656e-4074-8000-0a0027000000"},
+		{Name: "vboxnet0", Mode: NWMode_intnet},
+	}
+	calls := 0
+	r := NewNetworkRegistry(func() ([]Network, error) {
+		calls++
+		return append([]Network(nil), listed...), nil
+	}, time.Hour)
+
+	changes, err := r.Refresh(context.Background())
+	if err != nil {
+		t.Fatalf("error refreshing %v", err)
+	}
+	if len(changes.Added) != 3 || len(changes.Removed) != 0 {
+		t.Errorf("expected all networks added on first refresh, got %+v", changes)
+	}
+
+	if nws := r.ByMode(NWMode_hostonly); len(nws) != 2 || nws[0].Name != "vboxnet0" {
+		t.Errorf("expected hostonly networks sorted by name, got %+v", nws)
+	}
+	if nws := r.ByName("vboxnet0"); len(nws) != 2 {
+		t.Errorf("expected vboxnet0 in two modes, got %+v", nws)
+	}
+	if nw, ok := r.ByGUID("786f6276-656e-4174-8000-0a0027000001"); !ok || nw.Name != "vboxnet1" {
+		t.Errorf("expected vboxnet1 by guid, got %+v", nw)
+	}
+	if _, ok := r.Get(NWMode_natnetwork, "vboxnet0"); ok {
+		t.Errorf("expected no natnetwork vboxnet0")
+	}
+
+	// within the ttl the cached networks are served
+	listed = listed[1:]
+	if changes, err := r.Refresh(context.Background()); err != nil || !changes.Empty() || calls != 1 {
+		t.Errorf("expected cached networks, got %+v %v after %d listings", changes, err, calls)
+	}
+
+	listed = append(listed, Network{Name: "natnet1", Mode: NWMode_natnetwork})
+	r.Invalidate()
+	changes, err = r.Refresh(context.Background())
+	if err != nil {
+		t.Fatalf("error refreshing %v", err)
+	}
+	if len(changes.Added) != 1 || changes.Added[0].Name != "natnet1" {
+		t.Errorf("expected natnet1 added, got %+v", changes.Added)
+	}
+	if len(changes.Removed) != 1 || changes.Removed[0].Name != "vboxnet1" {
+		t.Errorf("expected vboxnet1 removed, got %+v", changes.Removed)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := r.ForceRefresh(ctx); err == nil {
+		t.Errorf("expected refresh with a cancelled context to fail")
+	}
+}
+
+func TestZeroVBoxNetworks(t *testing.T) {
+	var vb VBox
+	nws := vb.networks()
+	if nws == nil || vb.Networks != nws || nws.TTL != DefaultNetworkCacheTTL {
+		t.Fatalf("expected a registry created on first use, got %+v", nws)
+	}
+	vb.networks().Invalidate()
+	if vb.networks() != nws {
+		t.Errorf("expected the same registry on later calls")
+	}
+}
+
+func TestNetworkRegistryPut(t *testing.T) {
+	r := NewNetworkRegistry(func() ([]Network, error) { return nil, nil }, time.Hour)
+	r.Put(Network{Name: "natnet1", Mode: NWMode_natnetwork})
+	before, _ := r.Get(NWMode_natnetwork, "natnet1")
+
+	// networks handed to readers are replaced, not changed in place
+	updated := *before
+	updated.LowerIP = net.ParseIP("10.0.0.100")
+	r.Put(updated)
+	if before.LowerIP != nil {
+		t.Errorf("expected the network held by a reader to be left alone, got %+v", before)
+	}
+	if after, _ := r.Get(NWMode_natnetwork, "natnet1"); !after.LowerIP.Equal(updated.LowerIP) {
+		t.Errorf("expected the updated network, got %+v", after)
+	}
+}
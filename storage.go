@@ -0,0 +1,328 @@
+package virtualbox
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// chipsetBuses maps the controller types printed by showvminfo to their bus
+var chipsetBuses = map[StorageControllerChipset]StorageControllerType{
+	Chipset_PIIX3:       IDE,
+	Chipset_PIIX4:       IDE,
+	Chipset_ICH6:        IDE,
+	Chipset_IntelAhci:   SATA,
+	Chipset_LsiLogic:    SCSCI,
+	Chipset_BusLogic:    SCSCI,
+	Chipset_LsiLogicSas: SAS,
+	Chipset_NVMe:        NVME,
+	Chipset_VirtIO:      VirtIO,
+	"VirtioSCSI":        VirtIO, // showvminfo name of the virtio chipset
+	Chipset_USB:         USB,
+	Chipset_I82078:      Floppy,
+}
+
+// busLimits are the ports of a controller bus and the devices each port takes, e.g ide master and slave
+type busLimits struct {
+	maxPorts int
+	devices  int
+	// settablePorts buses have a port count that can be set up to maxPorts, others have a fixed count
+	settablePorts bool
+	// defaultPorts is the port count virtualbox gives a settable controller added without one
+	defaultPorts int
+}
+
+var storageBusLimits = map[StorageControllerType]busLimits{
+	IDE:    {maxPorts: 2, devices: 2},
+	SATA:   {maxPorts: 30, devices: 1, settablePorts: true, defaultPorts: 30},
+	SCSCI:  {maxPorts: 16, devices: 1},
+	SAS:    {maxPorts: 255, devices: 1, settablePorts: true, defaultPorts: 8},
+	NVME:   {maxPorts: 255, devices: 1, settablePorts: true, defaultPorts: 1}, // each port is a namespace
+	VirtIO: {maxPorts: 256, devices: 1, settablePorts: true, defaultPorts: 1},
+	USB:    {maxPorts: 8, devices: 1},
+	Floppy: {maxPorts: 1, devices: 2},
+}
+
+// devicesPerPort is the number of devices each port of a bus takes
+func devicesPerPort(bus StorageControllerType) int {
+	if limits, ok := storageBusLimits[bus]; ok {
+		return limits.devices
+	}
+	return 1
+}
+
+// allocatePorts assigns a port and device to the disks that are not pinned to one, see
+// StorageControllerAttachment.Pinned, and grows the port count of the controllers to fit their disks. A port count
+// left at 0 keeps the virtualbox default unless the disks need more ports. Pinned disks are placed first so that
+// the others are allocated around them
+func allocatePorts(ctrs []StorageController, disks []Disk, verr *ValidationErrors) {
+	byName := map[string]*StorageController{}
+	used := map[string]map[[2]int]bool{}
+	for i := range ctrs {
+		byName[ctrs[i].Name] = &ctrs[i]
+		used[ctrs[i].Name] = map[[2]int]bool{}
+	}
+
+	var unpinned []int
+	for i := range disks {
+		path := fmt.Sprintf("disk/%d/controller", i)
+		a := &disks[i].Controller
+
+		ctr, ok := byName[a.Name]
+		if !ok {
+			verr.Add(path, fmt.Errorf("storagecontroller ref %s did not resolve", a.Name))
+			continue
+		}
+		a.Type = ctr.Type
+
+		if !a.pinned() {
+			unpinned = append(unpinned, i)
+			continue
+		}
+
+		limits := storageBusLimits[ctr.Type]
+		if a.Port < 0 || a.Port >= limits.maxPorts || a.Device < 0 || a.Device >= limits.devices {
+			verr.Add(path, fmt.Errorf("port %d device %d is out of range for %s controller %s, which has %d ports of %d devices",
+				a.Port, a.Device, ctr.Type, ctr.Name, limits.maxPorts, limits.devices))
+			continue
+		}
+		slot := [2]int{a.Port, a.Device}
+		if used[ctr.Name][slot] {
+			verr.Add(path, fmt.Errorf("port %d device %d of %s is taken by another disk", a.Port, a.Device, ctr.Name))
+			continue
+		}
+		used[ctr.Name][slot] = true
+	}
+
+	for _, i := range unpinned {
+		a := &disks[i].Controller
+		if !nextFreeSlot(a, storageBusLimits[a.Type], used[a.Name]) {
+			verr.Add(fmt.Sprintf("disk/%d/controller", i), fmt.Errorf("no free port left on %s controller %s", a.Type, a.Name))
+		}
+	}
+
+	for i := range ctrs {
+		limits := storageBusLimits[ctrs[i].Type]
+		if ctrs[i].PortCount > limits.maxPorts {
+			verr.Add(fmt.Sprintf("storagecontroller/%s", ctrs[i].Name),
+				fmt.Errorf("%s controllers have at most %d ports, got %d", ctrs[i].Type, limits.maxPorts, ctrs[i].PortCount))
+		}
+		if !limits.settablePorts {
+			continue
+		}
+		ports := ctrs[i].PortCount
+		if ports == 0 {
+			ports = limits.defaultPorts
+		}
+		for slot := range used[ctrs[i].Name] {
+			if slot[0] >= ports {
+				ports = slot[0] + 1
+				ctrs[i].PortCount = ports
+			}
+		}
+	}
+}
+
+// nextFreeSlot assigns the first free port and device of a controller to a and marks it used
+func nextFreeSlot(a *StorageControllerAttachment, limits busLimits, used map[[2]int]bool) bool {
+	for port := 0; port < limits.maxPorts; port++ {
+		for device := 0; device < limits.devices; device++ {
+			if slot := [2]int{port, device}; !used[slot] {
+				used[slot] = true
+				a.Port, a.Device = port, device
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// pinned attachments keep the port and device they were given
+func (a StorageControllerAttachment) pinned() bool {
+	return a.Pinned || a.Port != 0 || a.Device != 0
+}
+
+// storageControllerSettingsXML maps the storage controllers of the settings file, which look like the following
+//  <StorageController name="SATA1" type="AHCI" PortCount="2" useHostIOCache="false" Bootable="true">
+//    <AttachedDevice type="HardDisk" hotpluggable="true" port="0" device="0" nonrotational="true" discard="true">
+//      <Image uuid="{0e3f0c1b-f523-4a50-b1a8-d1e8c9a508b4}"/>
+//    </AttachedDevice>
+//    <AttachedDevice passthrough="true" type="DVD" hotpluggable="false" port="1" device="0">
+//      <HostDrive src="/dev/sr0"/>
+//    </AttachedDevice>
+//  </StorageController>
+type storageControllerSettingsXML struct {
+	Name           string                      `xml:"name,attr"`
+	UseHostIOCache bool                        `xml:"useHostIOCache,attr"`
+	Devices        []attachedDeviceSettingsXML `xml:"AttachedDevice"`
+}
+
+type attachedDeviceSettingsXML struct {
+	Type          string `xml:"type,attr"`
+	Port          int    `xml:"port,attr"`
+	Device        int    `xml:"device,attr"`
+	HotPluggable  bool   `xml:"hotpluggable,attr"`
+	NonRotational bool   `xml:"nonrotational,attr"`
+	Discard       bool   `xml:"discard,attr"`
+	Passthrough   bool   `xml:"passthrough,attr"`
+}
+
+func (s *vmSettingsXML) storageController(name string) *storageControllerSettingsXML {
+	for i := range s.StorageControllers {
+		if s.StorageControllers[i].Name == name {
+			return &s.StorageControllers[i]
+		}
+	}
+	return nil
+}
+
+func (c *storageControllerSettingsXML) device(port, device int) *attachedDeviceSettingsXML {
+	for i := range c.Devices {
+		if c.Devices[i].Port == port && c.Devices[i].Device == device {
+			return &c.Devices[i]
+		}
+	}
+	return nil
+}
+
+// parseStorage reads the storage controllers and the disks attached to every port and device of them from the
+// showvminfo values, which look like the following
+//  storagecontrollername0="SATA1"
+//  storagecontrollertype0="IntelAhci"
+//  storagecontrollerinstance0="0"
+//  storagecontrollerportcount0="2"
+//  storagecontrollerbootable0="on"
+func parseStorage(m map[string]interface{}, settings *vmSettingsXML) ([]StorageController, []Disk, error) {
+	ctrs := make([]StorageController, 0, 2)
+	var disks []Disk
+
+	for i := 0; ; i++ {
+		name, ok := m[fmt.Sprintf("storagecontrollername%d", i)].(string)
+		if !ok { // no more storage controllers
+			break
+		}
+
+		sc := StorageController{Name: name}
+		if chipset, ok := m[fmt.Sprintf("storagecontrollertype%d", i)].(string); ok {
+			sc.Type = chipsetBuses[StorageControllerChipset(chipset)]
+			sc.Chipset = StorageControllerChipset(chipset)
+			if sc.Type == VirtIO {
+				sc.Chipset = Chipset_VirtIO
+			}
+		}
+
+		var err error
+		if sc.Instance, err = intValue(m, fmt.Sprintf("storagecontrollerinstance%d", i)); err != nil {
+			return nil, nil, err
+		}
+		if sc.PortCount, err = intValue(m, fmt.Sprintf("storagecontrollerportcount%d", i)); err != nil {
+			return nil, nil, err
+		}
+		if sb, ok := m[fmt.Sprintf("storagecontrollerbootable%d", i)]; ok {
+			if sc.Bootable, ok = sb.(string); !ok {
+				return nil, nil, fmt.Errorf("wrong val for storagecontrollerbootable")
+			}
+		}
+
+		xc := settings.storageController(name)
+		if xc != nil {
+			sc.HostIOCache = BoolPtr(xc.UseHostIOCache)
+		}
+
+		for port := 0; port < sc.PortCount; port++ {
+			for device := 0; device < devicesPerPort(sc.Type); device++ {
+				d, ok := attachedDisk(m, sc, port, device)
+				if !ok {
+					continue
+				}
+				if xc != nil {
+					if xd := xc.device(port, device); xd != nil {
+						xd.apply(&d)
+					}
+				}
+				disks = append(disks, d)
+			}
+		}
+
+		ctrs = append(ctrs, sc)
+	}
+
+	return ctrs, disks, nil
+}
+
+// intValue reads an int from the showvminfo values, which may have been quoted. Missing keys are 0
+func intValue(m map[string]interface{}, key string) (int, error) {
+	switch v := m[key].(type) {
+	case nil:
+		return 0, nil
+	case int:
+		return v, nil
+	case string:
+		i, err := strconv.Atoi(v)
+		if err != nil {
+			return 0, fmt.Errorf("wrong val for %s: %s", key, v)
+		}
+		return i, nil
+	}
+	return 0, fmt.Errorf("wrong val for %s", key)
+}
+
+// attachedDisk reads the medium attached to port and device of sc from the showvminfo values, which look like
+//  "SATA1-0-0"="/vms/vm1/disk1.vdi"
+//  "SATA1-ImageUUID-0-0"="0e3f0c1b-..."
+//  "SATA1-1-0"="emptydrive"
+//  "SATA1-IsEjected-1-0"="off"
+func attachedDisk(m map[string]interface{}, sc StorageController, port, device int) (Disk, bool) {
+	v, ok := m[fmt.Sprintf("%s-%d-%d", sc.Name, port, device)].(string)
+	if !ok || v == "none" {
+		return Disk{}, false
+	}
+
+	d := Disk{
+		Type: HDDrive,
+		Controller: StorageControllerAttachment{
+			Type:   sc.Type,
+			Port:   port,
+			Device: device,
+			Name:   sc.Name,
+		},
+	}
+
+	// only optical drives report whether their medium was ejected
+	_, ejectable := m[fmt.Sprintf("%s-IsEjected-%d-%d", sc.Name, port, device)]
+	removable := DVDDrive
+	if sc.Type == Floppy {
+		removable = FDDrive
+	}
+	switch {
+	case v == "emptydrive":
+		d.Type = removable
+	case strings.HasPrefix(v, "host:"):
+		d.Type, d.HostDrive = removable, strings.TrimPrefix(v, "host:")
+	default:
+		d.Path = v
+		if ejectable || sc.Type == Floppy {
+			d.Type = removable
+		}
+	}
+
+	if uuid, ok := m[fmt.Sprintf("%s-ImageUUID-%d-%d", sc.Name, port, device)].(string); ok {
+		d.UUID = uuid
+	}
+	return d, true
+}
+
+func (xd *attachedDeviceSettingsXML) apply(d *Disk) {
+	switch xd.Type {
+	case "HardDisk":
+		d.Type = HDDrive
+	case "DVD":
+		d.Type = DVDDrive
+	case "Floppy":
+		d.Type = FDDrive
+	}
+	d.HotPluggable = xd.HotPluggable
+	d.NonRotational = xd.NonRotational
+	d.AutoDiscard = xd.Discard
+	d.Passthrough = xd.Passthrough
+}
@@ -0,0 +1,172 @@
+package virtualbox
+
+import (
+	"encoding/xml"
+	"reflect"
+	"testing"
+)
+
+func TestAttachedDisk(t *testing.T) {
+	m := map[string]interface{}{
+		"SATA1-0-0":           "/vms/vm1/disk1.vdi",
+		"SATA1-ImageUUID-0-0": "0e3f0c1b-f523-4a50-b1a8-d1e8c9a508b4",
+		"SATA1-1-0":           "/isos/ubuntu.iso",
+		"SATA1-IsEjected-1-0": "off",
+		"SATA1-2-0":           "emptydrive",
+		"SATA1-3-0":           "host:/dev/sr0",
+		"SATA1-4-0":           "none",
+	}
+	sc := StorageController{Name: "SATA1", Type: SATA}
+
+	expected := []Disk{
+		{Path: "/vms/vm1/disk1.vdi", UUID: "0e3f0c1b-f523-4a50-b1a8-d1e8c9a508b4", Type: HDDrive},
+		{Path: "/isos/ubuntu.iso", Type: DVDDrive},
+		{Type: DVDDrive},
+		{HostDrive: "/dev/sr0", Type: DVDDrive},
+	}
+	for port := range expected {
+		expected[port].Controller = StorageControllerAttachment{Type: SATA, Port: port, Name: "SATA1"}
+		if actual, ok := attachedDisk(m, sc, port, 0); !ok || !reflect.DeepEqual(actual, expected[port]) {
+			t.Errorf("port %d expected %+v, got %+v", port, expected[port], actual)
+		}
+	}
+
+	if _, ok := attachedDisk(m, sc, 4, 0); ok {
+		t.Errorf("expected no disk on a port set to none")
+	}
+}
+
+func TestParseStorage(t *testing.T) {
+	m := map[string]interface{}{
+		"storagecontrollername0":      "IDE1",
+		"storagecontrollertype0":      "PIIX4",
+		"storagecontrollerinstance0":  "0",
+		"storagecontrollerportcount0": "2",
+		"storagecontrollerbootable0":  "on",
+		"IDE1-0-0":                    "/vms/vm1/disk1.vdi",
+		"IDE1-0-1":                    "none",
+		"IDE1-1-0":                    "none",
+		"IDE1-1-1":                    "/isos/ubuntu.iso",
+		"IDE1-IsEjected-1-1":          "off",
+		"storagecontrollername1":      "SATA1",
+		"storagecontrollertype1":      "IntelAhci",
+		"storagecontrollerinstance1":  "0",
+		"storagecontrollerportcount1": "2",
+		"storagecontrollerbootable1":  "on",
+		"SATA1-0-0":                   "/vms/vm1/disk2.vdi",
+		"SATA1-ImageUUID-0-0":         "0e3f0c1b-f523-4a50-b1a8-d1e8c9a508b4",
+		"SATA1-1-0":                   "/vms/vm1/volume1.vdi",
+	}
+
+	data := `<VirtualBox><Machine><StorageControllers>
+  <StorageController name="SATA1" type="AHCI" PortCount="2" useHostIOCache="true" Bootable="true">
+    <AttachedDevice type="HardDisk" hotpluggable="false" port="0" device="0" nonrotational="true" discard="true"/>
+    <AttachedDevice type="HardDisk" hotpluggable="true" port="1" device="0"/>
+  </StorageController>
+</StorageControllers></Machine></VirtualBox>`
+	var settings vmSettingsXML
+	if err := xml.Unmarshal([]byte(data), &settings); err != nil {
+		t.Fatalf("error parsing settings %v", err)
+	}
+
+	ctrs, disks, err := parseStorage(m, &settings)
+	if err != nil {
+		t.Fatalf("error parsing storage %v", err)
+	}
+
+	expectedCtrs := []StorageController{
+		{Name: "IDE1", Type: IDE, Chipset: Chipset_PIIX4, PortCount: 2, Bootable: "on"},
+		{Name: "SATA1", Type: SATA, Chipset: Chipset_IntelAhci, PortCount: 2, Bootable: "on", HostIOCache: BoolPtr(true)},
+	}
+	if !reflect.DeepEqual(ctrs, expectedCtrs) {
+		t.Errorf("expected controllers %+v, got %+v", expectedCtrs, ctrs)
+	}
+
+	expectedDisks := []Disk{
+		{Path: "/vms/vm1/disk1.vdi", Type: HDDrive, Controller: StorageControllerAttachment{Type: IDE, Name: "IDE1"}},
+		{Path: "/isos/ubuntu.iso", Type: DVDDrive, Controller: StorageControllerAttachment{Type: IDE, Name: "IDE1", Port: 1, Device: 1}},
+		{Path: "/vms/vm1/disk2.vdi", UUID: "0e3f0c1b-f523-4a50-b1a8-d1e8c9a508b4", Type: HDDrive, NonRotational: true, AutoDiscard: true,
+			Controller: StorageControllerAttachment{Type: SATA, Name: "SATA1"}},
+		{Path: "/vms/vm1/volume1.vdi", Type: HDDrive, HotPluggable: true, Controller: StorageControllerAttachment{Type: SATA, Name: "SATA1", Port: 1}},
+	}
+	if !reflect.DeepEqual(disks, expectedDisks) {
+		t.Errorf("expected disks %+v, got %+v", expectedDisks, disks)
+	}
+}
+
+func TestAllocatePorts(t *testing.T) {
+	ctrs := []StorageController{{Name: "IDE1", Type: IDE}, {Name: "SATA1", Type: SATA, PortCount: 1}}
+	disks := []Disk{
+		{Controller: StorageControllerAttachment{Name: "SATA1"}},
+		{Controller: StorageControllerAttachment{Name: "SATA1", Port: 0, Pinned: true}},
+		{Controller: StorageControllerAttachment{Name: "SATA1", Port: 5}},
+		{Controller: StorageControllerAttachment{Name: "IDE1"}},
+		{Controller: StorageControllerAttachment{Name: "IDE1"}},
+		{Controller: StorageControllerAttachment{Name: "IDE1"}},
+	}
+
+	var verr ValidationErrors
+	allocatePorts(ctrs, disks, &verr)
+	if len(verr.errors) > 0 {
+		t.Fatalf("unexpected validation errors %v", verr)
+	}
+
+	expected := [][2]int{{1, 0}, {0, 0}, {5, 0}, {0, 0}, {0, 1}, {1, 0}}
+	for i, d := range disks {
+		if actual := [2]int{d.Controller.Port, d.Controller.Device}; actual != expected[i] {
+			t.Errorf("disk %d expected port and device %v, got %v", i, expected[i], actual)
+		}
+	}
+	if disks[0].Controller.Type != SATA || disks[3].Controller.Type != IDE {
+		t.Errorf("expected bus types to follow the controllers, got %+v", disks)
+	}
+	if ctrs[1].PortCount != 6 {
+		t.Errorf("expected sata port count to grow to 6, got %d", ctrs[1].PortCount)
+	}
+	if ctrs[0].PortCount != 0 {
+		t.Errorf("expected ide port count to be left alone, got %d", ctrs[0].PortCount)
+	}
+
+	// a fifth disk does not fit an ide controller, a pinned disk cannot take a used port
+	disks = append(disks,
+		Disk{Controller: StorageControllerAttachment{Name: "IDE1"}},
+		Disk{Controller: StorageControllerAttachment{Name: "IDE1"}},
+		Disk{Controller: StorageControllerAttachment{Name: "SATA1", Port: 5}},
+		Disk{Controller: StorageControllerAttachment{Name: "SATA1", Port: 30}},
+		Disk{Controller: StorageControllerAttachment{Name: "NVME1"}},
+	)
+	for i := range disks {
+		disks[i].Controller.Pinned = true
+	}
+	for i := 6; i < 8; i++ {
+		disks[i].Controller.Pinned = false
+	}
+
+	verr = ValidationErrors{}
+	allocatePorts(ctrs, disks, &verr)
+	if len(verr.errors) != 4 {
+		t.Errorf("expected 4 validation errors, got %d: %v", len(verr.errors), verr)
+	}
+}
+
+func TestAllocatePortsDefaultCount(t *testing.T) {
+	// unset port counts keep the virtualbox default unless the disks need more ports
+	ctrs := []StorageController{{Name: "SATA1", Type: SATA}, {Name: "NVME1", Type: NVME}}
+	disks := []Disk{
+		{Controller: StorageControllerAttachment{Name: "SATA1"}},
+		{Controller: StorageControllerAttachment{Name: "SATA1", Port: 3}},
+		{Controller: StorageControllerAttachment{Name: "NVME1"}},
+		{Controller: StorageControllerAttachment{Name: "NVME1"}},
+	}
+	var verr ValidationErrors
+	allocatePorts(ctrs, disks, &verr)
+	if len(verr.errors) > 0 {
+		t.Fatalf("unexpected validation errors %v", verr)
+	}
+	if ctrs[0].PortCount != 0 {
+		t.Errorf("expected sata port count to keep the default, got %d", ctrs[0].PortCount)
+	}
+	if ctrs[1].PortCount != 2 {
+		t.Errorf("expected nvme port count to grow to 2, got %d", ctrs[1].PortCount)
+	}
+}
@@ -0,0 +1,140 @@
+package virtualbox
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/golang/glog"
+)
+
+type TopologyNodeKind string
+
+const (
+	TopologyVM      = TopologyNodeKind("vm")
+	TopologyNIC     = TopologyNodeKind("nic")
+	TopologyNetwork = TopologyNodeKind("network")
+)
+
+type TopologyNode struct {
+	ID    string            `json:"id"`
+	Kind  TopologyNodeKind  `json:"kind"`
+	Label string            `json:"label"`
+	Attrs map[string]string `json:"attrs,omitempty"`
+}
+
+type TopologyEdge struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// Topology is a graph of vms, their nics and the networks the nics are plugged into
+type Topology struct {
+	Nodes []TopologyNode `json:"nodes"`
+	Edges []TopologyEdge `json:"edges"`
+}
+
+// TopologyGraph builds the topology of all registered vms. Vms that cannot be inspected are left out
+func (vb *VBox) TopologyGraph() (*Topology, error) {
+	if err := vb.SyncNICs(); err != nil {
+		return nil, err
+	}
+
+	list, err := vb.ListVMs()
+	if err != nil {
+		return nil, err
+	}
+
+	var vms []*VirtualMachine
+	for i := range list {
+		vm, err := vb.VMInfo(list[i].UUIDOrName())
+		if err != nil {
+			glog.Warningf("leaving vm %s out of the topology: %v", list[i].Spec.Name, err)
+			continue
+		}
+		vms = append(vms, vm)
+	}
+
+	return buildTopology(vms, vb.networks().All()), nil
+}
+
+func buildTopology(vms []*VirtualMachine, nws []*Network) *Topology {
+	t := &Topology{}
+	nodes := map[string]bool{}
+
+	addNetwork := func(mode NetworkMode, name string, nw *Network) string {
+		id := fmt.Sprintf("net:%s/%s", mode, name)
+		if !nodes[id] {
+			nodes[id] = true
+			attrs := map[string]string{"mode": string(mode)}
+			if nw != nil && nw.IPNet.IP != nil {
+				attrs["ipnet"] = nw.IPNet.String()
+			}
+			t.Nodes = append(t.Nodes, TopologyNode{ID: id, Kind: TopologyNetwork, Label: name, Attrs: attrs})
+		}
+		return id
+	}
+
+	for _, nw := range nws {
+		addNetwork(nw.Mode, nw.Name, nw)
+	}
+
+	for _, vm := range vms {
+		vmID := "vm:" + vm.Spec.Name
+		t.Nodes = append(t.Nodes, TopologyNode{ID: vmID, Kind: TopologyVM, Label: vm.Spec.Name,
+			Attrs: map[string]string{"uuid": vm.UUID}})
+
+		for _, nic := range vm.Spec.NICs {
+			nicID := fmt.Sprintf("nic:%s/%d", vm.Spec.Name, nic.Index)
+			t.Nodes = append(t.Nodes, TopologyNode{ID: nicID, Kind: TopologyNIC, Label: fmt.Sprintf("nic%d", nic.Index),
+				Attrs: map[string]string{"mode": string(nic.Mode), "mac": nic.MAC}})
+			t.Edges = append(t.Edges, TopologyEdge{From: vmID, To: nicID})
+
+			// nat and null nics are private to the vm, internal networks only show up in listings while in use
+			if _, named := nicNetworkKeys[nic.Mode]; named && nic.Mode != NWMode_generic && nic.NetworkName != "" {
+				t.Edges = append(t.Edges, TopologyEdge{From: nicID, To: addNetwork(nic.Mode, nic.NetworkName, nil)})
+			}
+		}
+	}
+
+	sort.Slice(t.Nodes, func(i, j int) bool { return t.Nodes[i].ID < t.Nodes[j].ID })
+	sort.Slice(t.Edges, func(i, j int) bool {
+		if t.Edges[i].From != t.Edges[j].From {
+			return t.Edges[i].From < t.Edges[j].From
+		}
+		return t.Edges[i].To < t.Edges[j].To
+	})
+	return t
+}
+
+// DOT renders the topology as an undirected graphviz graph
+func (t *Topology) DOT() string {
+	shapes := map[TopologyNodeKind]string{TopologyVM: "box", TopologyNIC: "ellipse", TopologyNetwork: "diamond"}
+
+	var b bytes.Buffer
+	b.WriteString("graph topology {\n")
+	for _, n := range t.Nodes {
+		label := n.Label
+		switch n.Kind {
+		case TopologyNIC:
+			label += "\n" + n.Attrs["mac"]
+		case TopologyNetwork:
+			label += "\n" + n.Attrs["mode"]
+			if ipnet, ok := n.Attrs["ipnet"]; ok {
+				label += "\n" + ipnet
+			}
+		}
+		fmt.Fprintf(&b, "  %s [label=%s, shape=%s];\n", strconv.Quote(n.ID), strconv.Quote(label), shapes[n.Kind])
+	}
+	for _, e := range t.Edges {
+		fmt.Fprintf(&b, "  %s -- %s;\n", strconv.Quote(e.From), strconv.Quote(e.To))
+	}
+	b.WriteString("}\n")
+	return b.String()
+}
+
+func (t *Topology) JSON() ([]byte, error) {
+	return json.MarshalIndent(t, "", "  ")
+}
@@ -0,0 +1,48 @@
+package virtualbox
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestBuildTopology(t *testing.T) {
+	vm1 := &VirtualMachine{UUID: "1"}
+	vm1.Spec.Name = "vm01"
+	vm1.Spec.NICs = []NIC{
+		{Index: 1, Mode: NWMode_hostonly, NetworkName: "vboxnet0", MAC: "080027000001"},
+		{Index: 2, Mode: NWMode_intnet, NetworkName: "backend", MAC: "080027000002"},
+	}
+
+	vm2 := &VirtualMachine{UUID: "2"}
+	vm2.Spec.Name = "vm02"
+	vm2.Spec.NICs = []NIC{
+		{Index: 1, Mode: NWMode_intnet, NetworkName: "backend", MAC: "080027000003"},
+		{Index: 2, Mode: NWMode_nat, MAC: "080027000004"},
+	}
+
+	topology := buildTopology([]*VirtualMachine{vm1, vm2}, []*Network{{Name: "vboxnet0", Mode: NWMode_hostonly}})
+
+	// 2 vms, 4 nics, the hostonly network and the internal network only known through the nics
+	if len(topology.Nodes) != 8 {
+		t.Errorf("expected 8 nodes, got %#v", topology.Nodes)
+	}
+	// 4 vm to nic edges, 3 nic to network edges as nat is private to the vm
+	if len(topology.Edges) != 7 {
+		t.Errorf("expected 7 edges, got %#v", topology.Edges)
+	}
+
+	dot := topology.DOT()
+	if !strings.Contains(dot, `"nic:vm02/1" -- "net:intnet/backend";`) {
+		t.Errorf("expected vm02 to be plugged into backend, got\n%s", dot)
+	}
+
+	data, err := topology.JSON()
+	if err != nil {
+		t.Fatalf("error rendering json %v", err)
+	}
+	var decoded Topology
+	if err := json.Unmarshal(data, &decoded); err != nil || len(decoded.Nodes) != len(topology.Nodes) {
+		t.Errorf("json does not round trip, got %s", data)
+	}
+}
@@ -1,14 +1,50 @@
 package virtualbox
 
-import "net"
+import (
+	"net"
+	"strings"
+	"time"
+)
 
 type StorageControllerType string
 
 const (
-	IDE   = StorageControllerType("IDE")
-	SATA  = StorageControllerType("SATA")
-	SCSCI = StorageControllerType("SCSCI")
-	NVME  = StorageControllerType("NVME")
+	IDE    = StorageControllerType("IDE")
+	SATA   = StorageControllerType("SATA")
+	SCSCI  = StorageControllerType("SCSCI")
+	NVME   = StorageControllerType("NVME")
+	SAS    = StorageControllerType("SAS")
+	USB    = StorageControllerType("USB")
+	VirtIO = StorageControllerType("VirtIO")
+	Floppy = StorageControllerType("Floppy")
+)
+
+// ForStorageCtl is the bus name storagectl --add expects for the controller type
+func (t StorageControllerType) ForStorageCtl() string {
+	switch t {
+	case SCSCI:
+		return "scsi"
+	case NVME:
+		return "pcie"
+	}
+	return strings.ToLower(string(t))
+}
+
+// StorageControllerChipset is the emulated controller hardware, each chipset belongs to one bus type
+type StorageControllerChipset string
+
+const (
+	Chipset_PIIX3       = StorageControllerChipset("PIIX3")       // IDE
+	Chipset_PIIX4       = StorageControllerChipset("PIIX4")       // IDE
+	Chipset_ICH6        = StorageControllerChipset("ICH6")        // IDE
+	Chipset_IntelAhci   = StorageControllerChipset("IntelAhci")   // SATA
+	Chipset_LsiLogic    = StorageControllerChipset("LsiLogic")    // SCSI
+	Chipset_BusLogic    = StorageControllerChipset("BusLogic")    // SCSI
+	Chipset_LsiLogicSas = StorageControllerChipset("LsiLogicSas") // SAS
+	Chipset_NVMe        = StorageControllerChipset("NVMe")        // NVMe
+	Chipset_VirtIO      = StorageControllerChipset("VirtIO")      // VirtIO
+	Chipset_USB         = StorageControllerChipset("USB")         // USB
+	Chipset_I82078      = StorageControllerChipset("I82078")      // Floppy
 )
 
 type DiskType string
@@ -39,6 +75,43 @@ type Disk struct {
 	Type          DiskType
 	NonRotational bool
 	AutoDiscard   bool
+
+	// HostDrive is a host optical drive, e.g /dev/sr0, attached to a DVDDrive instead of an image. DVDDrives
+	// without a Path or HostDrive are attached empty
+	HostDrive string
+	// Passthrough lets the vm send commands to the HostDrive directly, e.g to burn discs
+	Passthrough bool
+	// RawDevice is a host block device, e.g /dev/sdb or /dev/loop0, that EnsureDisk maps into a VMDK at Path.
+	// RawPartitions limits the vm to the listed partitions of the device, all of it is passed through otherwise
+	RawDevice     string
+	RawPartitions []int
+
+	// Encryption, when set, makes EnsureDisk encrypt the disk and Start hand its password to the vm
+	Encryption *DiskEncryption
+
+	// HotPluggable marks the port of the disk so that it can be attached and detached while the vm runs, only
+	// SATA ports support it and the mark can only be set while the vm is powered off
+	HotPluggable bool
+
+	// MediumType is applied by EnsureDisk when set and reported by DiskInfo and ListMedia
+	MediumType MediumType
+	// Variants and Properties are used by CreateDisk and reported by DiskInfo and ListMedia. Variants default
+	// to a dynamically allocated disk
+	Variants   []DiskVariant
+	Properties map[string]string
+
+	// the following are reported by DiskInfo and ListMedia
+	ParentUUID   string
+	ChildUUIDs   []string
+	State        string // e.g created, inaccessible, locked-write
+	SizeOnDiskMB int64
+	Encrypted    bool
+	// InUseByVMs holds the uuids of the vms the disk is attached to
+	InUseByVMs []string
+	// Parent makes a spec disk a differencing child of the parent disk, see EnsureDisk. Parent and Children
+	// also link the differencing chain of disks returned by ListMedia
+	Parent   *Disk
+	Children []*Disk
 }
 
 type StorageControllerAttachment struct {
@@ -48,14 +121,22 @@ type StorageControllerAttachment struct {
 	Device int
 	// Name of the storage controller target for this attachment
 	Name string
+	// Pinned keeps Port and Device as set, EnsureDefaults assigns them otherwise. Attachments with a non zero
+	// Port or Device are always pinned
+	Pinned bool
 }
 
 type StorageController struct {
-	Name      string
-	Type      StorageControllerType
+	Name string
+	Type StorageControllerType
+	// Chipset defaults to the one virtualbox picks for Type
+	Chipset StorageControllerChipset
+	// Instance is assigned by virtualbox and only reported
 	Instance  int
 	PortCount int
 	Bootable  string //on, off
+	// HostIOCache makes the host cache the disk io of the controller, nil keeps the virtualbox default
+	HostIOCache *bool
 }
 
 type CPU struct {
@@ -76,7 +157,9 @@ const (
 	NWMode_bridged    = NetworkMode("bridged")
 	NWMode_intnet     = NetworkMode("intnet")
 	NWMode_hostonly   = NetworkMode("hostonly")
-	NWMode_generic    = NetworkMode("generic")
+	// NWMode_hostonlynet is the host-only network model of VirtualBox 7, replacing hostonly interfaces on macOS
+	NWMode_hostonlynet = NetworkMode("hostonlynet")
+	NWMode_generic     = NetworkMode("generic")
 )
 
 type NICType string
@@ -90,6 +173,19 @@ const (
 	NIC_virtio    = NICType("virtio")
 )
 
+// promiscuous modes of a nic, see NIC.PromiscuousMode
+const (
+	PromiscMode_deny     = "deny"
+	PromiscMode_allowvms = "allow-vms"
+	PromiscMode_allowall = "allow-all"
+)
+
+// drivers of generic nics, see NIC.Properties for their settings
+const (
+	GenericDriver_UDPTunnel = "UDPTunnel"
+	GenericDriver_VDE       = "VDE"
+)
+
 type NIC struct {
 	Index int
 	//	Name            string      // device name of this nic, used for correlation with Adapters
@@ -101,6 +197,9 @@ type NIC struct {
 	BootPrio        int
 	PromiscuousMode string
 	MAC             string //auto assigns mac automatically
+	BandwidthGroup  string // optional name of a bandwidth group of the vm to cap this nic
+	// Properties are passed to the driver of generic nics, NetworkName names the driver
+	Properties map[string]string
 }
 
 type Network struct {
@@ -110,6 +209,9 @@ type Network struct {
 	Mode       NetworkMode
 	DeviceName string
 	HWAddress  string
+	// LowerIP and UpperIP bound the addresses handed out on a hostonlynet, defaults to the whole of IPNet
+	LowerIP net.IP
+	UpperIP net.IP
 }
 
 type BootDevice string
@@ -127,6 +229,7 @@ type VirtualMachineSpec struct {
 	OSType             OSType
 	StorageControllers []StorageController
 	Boot               []BootDevice
+	BandwidthGroups    []BandwidthGroup
 }
 
 type VirtualMachine struct {
@@ -134,6 +237,16 @@ type VirtualMachine struct {
 	Spec VirtualMachineSpec
 }
 
+// nic returns the nic of the spec with the given 1 based index, or nil
+func (vm *VirtualMachine) nic(index int) *NIC {
+	for i := range vm.Spec.NICs {
+		if vm.Spec.NICs[i].Index == index {
+			return &vm.Spec.NICs[i]
+		}
+	}
+	return nil
+}
+
 func (vm *VirtualMachine) UUIDOrName() string {
 	if vm.UUID == "" {
 		return vm.Spec.Name
@@ -143,12 +256,60 @@ func (vm *VirtualMachine) UUIDOrName() string {
 }
 
 type DHCPServer struct {
-	IPAddress      string
+	DHCPServerConfig
+}
+
+// DHCPServerConfig describes a dhcp server, targeted either by NetworkName (--netname) or by the host-only
+// Interface (--interface)
+type DHCPServerConfig struct {
 	NetworkName    string
+	Interface      string
+	IPAddress      string
 	NetworkMask    string
 	LowerIPAddress string
 	UpperIPAddress string
-	Enabled        bool
+	// Enabled turns the server on or off, nil leaves it as is
+	Enabled *bool
+
+	// Global options apply to every client of the server
+	Global DHCPOptions
+	Groups []DHCPGroupConfig
+	VMs    []DHCPVMConfig
+	MACs   []DHCPMACConfig
+}
+
+// DHCPOptions are the dhcp options handed out to clients in a scope
+type DHCPOptions struct {
+	DNS       []string // option 6
+	Router    string   // option 3
+	Domain    string   // option 15
+	LeaseTime time.Duration
+	// Other holds any further options keyed by their dhcp option number
+	Other map[int]string
+}
+
+// DHCPGroupConfig scopes options to the clients matching any of MACs
+type DHCPGroupConfig struct {
+	Name    string
+	MACs    []string
+	Options DHCPOptions
+}
+
+// DHCPVMConfig scopes options and an optional fixed address to a nic of a vm
+type DHCPVMConfig struct {
+	VM           string // name or uuid
+	NIC          int
+	FixedAddress string
+	Options      DHCPOptions
+	// Remove drops the config of the nic from the server, the other fields are ignored
+	Remove bool
+}
+
+// DHCPMACConfig scopes options and an optional fixed address to a mac address
+type DHCPMACConfig struct {
+	MAC          string
+	FixedAddress string
+	Options      DHCPOptions
 }
 
 type OSType struct {
@@ -41,3 +41,8 @@ func tryParseKeyValues(stdOut string, regexp *regexp.Regexp, callback func(key,
 
 	return s.Err()
 }
+
+// BoolPtr returns a pointer to b, for optional settings like DHCPServerConfig.Enabled
+func BoolPtr(b bool) *bool {
+	return &b
+}
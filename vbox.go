@@ -8,7 +8,11 @@ import (
 	"os/user"
 	"path/filepath"
 	"regexp"
+	"runtime"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/golang/glog"
 )
@@ -38,31 +42,59 @@ type Config struct {
 
 	// expected to be managed by this tool
 	Networks []Network
+
+	// MACAllocation, when set, makes SetNICDefaults assign stable macs to nics that do not set one
+	MACAllocation *MACAllocationConfig
+
+	// IPAM, when set, allocates subnets for Networks that do not declare an IPNet and static addresses for
+	// the vm nics attached to them
+	IPAM *IPAMConfig
+
+	// NetworkCacheTTL is how long discovered networks are reused before being listed again, defaults to
+	// DefaultNetworkCacheTTL. A negative value lists the networks every time they are needed
+	NetworkCacheTTL time.Duration
 }
 
 // VBox uses the VBoxManage command for its functionality
 type VBox struct {
 	Config  Config
 	Verbose bool
-	// as discovered and includes networks created out of band (not through this api)
-	// TODO: Merge them to a single map and provide accessors for specific filtering
-	HostOnlyNws map[string]*Network
-	BridgedNws  map[string]*Network
-	InternalNws map[string]*Network
-	NatNws      map[string]*Network
+	// as discovered and includes networks created out of band (not through this api). Created on first use
+	// for VBox values not made by NewVBox
+	Networks     *NetworkRegistry
+	networksOnce sync.Once
+
+	// version of VBoxManage, cached on first use
+	version string
+	// guards the ipam state file
+	ipamLock sync.Mutex
 }
 
 func NewVBox(config Config) *VBox {
 	if config.BasePath == "" {
 		config.BasePath = DefaultVBBasePath
 	}
-	return &VBox{
-		Config:      config,
-		HostOnlyNws: make(map[string]*Network),
-		BridgedNws:  make(map[string]*Network),
-		InternalNws: make(map[string]*Network),
-		NatNws:      make(map[string]*Network),
+	if config.NetworkCacheTTL == 0 {
+		config.NetworkCacheTTL = DefaultNetworkCacheTTL
 	}
+	vb := &VBox{Config: config}
+	vb.networks()
+	return vb
+}
+
+// networks returns vb.Networks, creating it when vb was not made by NewVBox
+func (vb *VBox) networks() *NetworkRegistry {
+	vb.networksOnce.Do(func() {
+		if vb.Networks != nil {
+			return
+		}
+		ttl := vb.Config.NetworkCacheTTL
+		if ttl == 0 {
+			ttl = DefaultNetworkCacheTTL
+		}
+		vb.Networks = NewNetworkRegistry(vb.listNetworks, ttl)
+	})
+	return vb.Networks
 }
 
 func GetDefaultVBBasePath() string {
@@ -124,6 +156,46 @@ func (vb *VBox) manage(args ...string) (string, error) {
 	return string(stdout.Bytes()), err
 }
 
+// Version returns the version reported by VBoxManage, e.g 7.0.10r158379
+func (vb *VBox) Version() (string, error) {
+	if vb.version != "" {
+		return vb.version, nil
+	}
+
+	out, err := vb.manage("--version")
+	if err != nil {
+		return "", err
+	}
+	vb.version = strings.TrimSpace(out)
+	return vb.version, nil
+}
+
+// MajorVersion returns the major component of Version, e.g 7
+func (vb *VBox) MajorVersion() (int, error) {
+	version, err := vb.Version()
+	if err != nil {
+		return 0, err
+	}
+
+	major, err := strconv.Atoi(strings.SplitN(version, ".", 2)[0])
+	if err != nil {
+		return 0, fmt.Errorf("cannot parse virtualbox version %s", version)
+	}
+	return major, nil
+}
+
+// HostOnlyMode returns the host-only networking model to use on this host. VirtualBox 7 on macOS manages them
+// as hostonlynets, other hosts and older versions as hostonly interfaces
+func (vb *VBox) HostOnlyMode() NetworkMode {
+	if runtime.GOOS != "darwin" {
+		return NWMode_hostonly
+	}
+	if major, err := vb.MajorVersion(); err == nil && major >= 7 {
+		return NWMode_hostonlynet
+	}
+	return NWMode_hostonly
+}
+
 func (vb *VBox) modify(vm *VirtualMachine, args ...string) (string, error) {
 	return vb.manage(append([]string{"modifyvm", vm.UUIDOrName()}, args...)...)
 }
@@ -138,34 +210,7 @@ func (vb *VBox) ListDHCPServers() (map[string]*DHCPServer, error) {
 		return nil, err
 	}
 
-	m := make(map[string]*DHCPServer)
-
-	var dhcpServer *DHCPServer
-
-	err = parseKeyValues(listOutput, reColonLine, func(key, val string) error {
-		switch key {
-		case "NetworkName":
-			dhcpServer = &DHCPServer{}
-			m[val] = dhcpServer
-			dhcpServer.NetworkName = val
-		case "IP":
-			dhcpServer.IPAddress = val
-		case "upperIPAddress":
-			dhcpServer.UpperIPAddress = val
-		case "lowerIPAddress":
-			dhcpServer.LowerIPAddress = val
-		case "NetworkMask":
-			dhcpServer.NetworkMask = val
-		case "Enabled":
-			dhcpServer.Enabled = val == "Yes"
-		}
-		return nil
-	})
-	if err != nil {
-		return nil, err
-	}
-
-	return m, nil
+	return parseDHCPServers(listOutput)
 }
 
 func (vb *VBox) ListOSTypes() (map[string]*OSType, error) {
@@ -203,6 +248,5 @@ func (vb *VBox) ListOSTypes() (map[string]*OSType, error) {
 }
 
 func (vb *VBox) MarkHDImmutable(hdPath string) error {
-	vb.manage("modifyhd", hdPath, "--type", "immutable")
-	return nil
+	return vb.SetMediumType(&Disk{Path: hdPath, Type: HDDrive}, MediumType_immutable)
 }
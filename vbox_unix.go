@@ -2,6 +2,30 @@
 
 package virtualbox
 
+import (
+	"os"
+	"os/user"
+	"path/filepath"
+	"runtime"
+)
+
 func vboxManagePath() string {
 	return VBoxManage
 }
+
+// vboxUserHome is where virtualbox keeps its global settings and dhcp leases
+func vboxUserHome() string {
+	if home := os.Getenv("VBOX_USER_HOME"); home != "" {
+		return home
+	}
+
+	u, err := user.Current()
+	if err != nil {
+		return ""
+	}
+
+	if runtime.GOOS == "darwin" {
+		return filepath.Join(u.HomeDir, "Library", "VirtualBox")
+	}
+	return filepath.Join(u.HomeDir, ".config", "VirtualBox")
+}
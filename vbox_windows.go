@@ -3,6 +3,8 @@
 package virtualbox
 
 import (
+	"os"
+	"os/user"
 	"path/filepath"
 
 	"golang.org/x/sys/windows/registry"
@@ -21,3 +23,16 @@ func vboxManagePath() string {
 	}
 	return filepath.Join(s, VBoxManage)
 }
+
+// vboxUserHome is where virtualbox keeps its global settings and dhcp leases
+func vboxUserHome() string {
+	if home := os.Getenv("VBOX_USER_HOME"); home != "" {
+		return home
+	}
+
+	u, err := user.Current()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(u.HomeDir, ".VirtualBox")
+}